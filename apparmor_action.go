@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+/* Installs AppArmor profiles from the recipe and enables loading them at
+ * boot. The kernel still needs AppArmor enabled, e.g. with apparmor=1
+ * security=apparmor on the commandline for kernels defaulting to another
+ * LSM */
+type AppArmorAction struct {
+	BaseAction `yaml:",inline"`
+	Profiles   []string // Profile files, relative to the recipe
+}
+
+func (aa *AppArmorAction) Verify(context *DebosContext) error {
+	if len(aa.Profiles) == 0 {
+		return errors.New("No AppArmor profiles given")
+	}
+
+	for _, p := range aa.Profiles {
+		if _, err := os.Stat(CleanPathAt(p, context.recipeDir)); err != nil {
+			return fmt.Errorf("Couldn't find AppArmor profile: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (aa *AppArmorAction) Run(context *DebosContext) error {
+	aa.LogStart()
+
+	dir := path.Join(context.rootdir, "etc/apparmor.d")
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("AppArmor isn't installed in the rootfs: %v", err)
+	}
+
+	for _, p := range aa.Profiles {
+		err := CopyFile(CleanPathAt(p, context.recipeDir), path.Join(dir, path.Base(p)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Check the profiles parse with the parser they will be loaded with */
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	for _, p := range aa.Profiles {
+		err := c.Run("apparmor", "apparmor_parser", "--skip-kernel-load", "--skip-cache",
+			path.Join("/etc/apparmor.d", path.Base(p)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return Command{}.Run("apparmor", "systemctl", "--root", context.rootdir, "enable", "apparmor.service")
+}
@@ -1,9 +1,92 @@
 package main
 
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
 type AptAction struct {
 	BaseAction `yaml:",inline"`
 	Recommends bool
 	Packages   []string
+	Manifest   string   // File with packages to install at exact versions
+	Keyrings   []string // Keys to trust, installed to trusted.gpg.d
+	Secure     bool     // Refuse unsigned repositories and packages
+	pinned     []string
+}
+
+var packageRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?$`)
+var versionRegexp = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~:-]*$`)
+
+/* Parse a package manifest, either pkg=version lines, dpkg-query -W output
+ * (pkg<tab>version) or dpkg --get-selections output. Selections carry no
+ * version, so those packages just get installed */
+func parseAptManifest(content string) ([]string, error) {
+	var packages []string
+
+	for n, l := range strings.Split(content, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		var name, version string
+		if strings.Contains(l, "=") {
+			parts := strings.SplitN(l, "=", 2)
+			name, version = parts[0], parts[1]
+		} else {
+			fields := strings.Fields(l)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected package and version", n+1)
+			}
+			name, version = fields[0], fields[1]
+			switch version {
+			case "install", "hold":
+				version = ""
+			case "deinstall", "purge":
+				continue
+			}
+		}
+
+		if !packageRegexp.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid package name %s", n+1, name)
+		}
+		if version == "" {
+			packages = append(packages, name)
+			continue
+		}
+		if !versionRegexp.MatchString(version) {
+			return nil, fmt.Errorf("line %d: invalid version %s", n+1, version)
+		}
+		packages = append(packages, fmt.Sprintf("%s=%s", name, version))
+	}
+
+	return packages, nil
+}
+
+func (apt *AptAction) Verify(context *DebosContext) error {
+	err := checkKeyrings(context, apt.Keyrings)
+	if err != nil {
+		return err
+	}
+
+	if apt.Manifest == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(CleanPathAt(apt.Manifest, context.recipeDir))
+	if err != nil {
+		return fmt.Errorf("Couldn't read manifest: %v", err)
+	}
+
+	apt.pinned, err = parseAptManifest(string(content))
+	if err != nil {
+		return fmt.Errorf("Invalid manifest %s: %v", apt.Manifest, err)
+	}
+
+	return nil
 }
 
 func (apt *AptAction) Run(context *DebosContext) error {
@@ -14,24 +97,32 @@ func (apt *AptAction) Run(context *DebosContext) error {
 		aptOptions = append(aptOptions, "--no-install-recommends")
 	}
 
+	if len(apt.pinned) > 0 {
+		/* Pinned versions may well be older than what the base has */
+		aptOptions = append(aptOptions, "--allow-downgrades")
+	}
+
 	aptOptions = append(aptOptions, "install")
 	aptOptions = append(aptOptions, apt.Packages...)
+	aptOptions = append(aptOptions, apt.pinned...)
 
-	c := NewChrootCommand(context.rootdir, context.Architecture)
-	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
-
-	err := c.Run("apt", "apt-get", "update")
-	if err != nil {
-		return err
-	}
-	err = c.Run("apt", aptOptions...)
-	if err != nil {
-		return err
-	}
-	err = c.Run("apt", "apt-get", "clean")
+	err := setupAptTrust(context, apt.Keyrings, apt.Secure)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+
+	return withAptProxy(context, func() error {
+		err := c.Run("apt", "apt-get", "update")
+		if err != nil {
+			return err
+		}
+		err = c.Run("apt", aptOptions...)
+		if err != nil {
+			return err
+		}
+		return c.Run("apt", "apt-get", "clean")
+	})
 }
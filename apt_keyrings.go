@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/* apt configuration refusing anything that isn't signed by a trusted key */
+const aptSecureConf = `Acquire::AllowInsecureRepositories "false";
+Acquire::AllowDowngradeToInsecureRepositories "false";
+APT::Get::AllowUnauthenticated "false";
+`
+
+/* Keyrings for trusted.gpg.d are either binary (.gpg) or ascii armored
+ * (.asc), apt goes by the extension */
+func checkKeyring(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't read keyring: %v", err)
+	}
+
+	switch path.Ext(file) {
+	case ".asc":
+		if !bytes.Contains(content, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+			return fmt.Errorf("%s isn't an armored public key", file)
+		}
+	case ".gpg":
+		/* Every OpenPGP packet starts with the high bit set */
+		if len(content) == 0 || content[0]&0x80 == 0 {
+			return fmt.Errorf("%s isn't a binary keyring", file)
+		}
+	default:
+		return fmt.Errorf("Keyring %s should be a .gpg or .asc file", file)
+	}
+
+	return nil
+}
+
+/* Keyrings are files in the recipe, or host keyrings of a gpg-import action
+ * run before, which only get written when it runs */
+func keyringPath(context *DebosContext, keyring string) string {
+	if imported, err := context.StringValue("keyring." + keyring); err == nil {
+		return imported
+	}
+	return CleanPathAt(keyring, context.recipeDir)
+}
+
+func checkKeyrings(context *DebosContext, keyrings []string) error {
+	for _, k := range keyrings {
+		if _, ok := context.Value("keyring." + k); ok {
+			continue
+		}
+		err := checkKeyring(CleanPathAt(k, context.recipeDir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Binary keyrings are just the keys one after the other, so combine them
+ * like that, armored ones dearmored first */
+func mergeKeyrings(context *DebosContext, keyrings []string, dst string) error {
+	var merged []byte
+	for _, k := range keyrings {
+		file := keyringPath(context, k)
+		var content []byte
+		var err error
+		if path.Ext(file) == ".asc" {
+			content, err = exec.Command("gpg", "--batch", "--dearmor", "--output", "-", file).Output()
+		} else {
+			content, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't read keyring %s: %v", k, err)
+		}
+		merged = append(merged, content...)
+	}
+
+	return ioutil.WriteFile(dst, merged, 0644)
+}
+
+/* Install keyrings as trusted by apt and with secure set, make apt refuse
+ * unsigned repositories and unauthenticated packages */
+func setupAptTrust(context *DebosContext, keyrings []string, secure bool) error {
+	dir := path.Join(context.rootdir, "etc/apt/trusted.gpg.d")
+	if len(keyrings) > 0 {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range keyrings {
+		name := strings.Replace(path.Base(k), " ", "_", -1)
+		err := CopyFile(keyringPath(context, k), path.Join(dir, name), 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't install keyring %s: %v", k, err)
+		}
+	}
+
+	if secure {
+		conf := path.Join(context.rootdir, "etc/apt/apt.conf.d/50debos-secure")
+		err := os.MkdirAll(path.Dir(conf), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(conf, []byte(aptSecureConf), 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't write apt configuration: %v", err)
+		}
+	}
+
+	return nil
+}
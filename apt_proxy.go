@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+/* apt configuration for the --apt-proxy, only there while apt runs so the
+ * image never refers to the proxy */
+const aptProxyConf = "etc/apt/apt.conf.d/00debos-proxy"
+
+/* Run f with apt in the rootfs going through the build proxy, if there is
+ * one. The configuration is removed again however f ends */
+func withAptProxy(context *DebosContext, f func() error) error {
+	if context.aptProxy == "" {
+		return f()
+	}
+
+	conf := path.Join(context.rootdir, aptProxyConf)
+	err := os.MkdirAll(path.Dir(conf), 0755)
+	if err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("Acquire::http::Proxy \"%s\";\n", context.aptProxy)
+	err = ioutil.WriteFile(conf, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't set up the apt proxy: %v", err)
+	}
+	defer os.Remove(conf)
+
+	return f()
+}
+
+/* Commands fetching packages outside of the rootfs apt, e.g. debootstrap,
+ * take the proxy from the environment */
+func addProxyEnv(context *DebosContext, c *Command) {
+	if context.aptProxy != "" {
+		c.AddEnvKey("http_proxy", context.aptProxy)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAptProxy(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "debos-proxy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	context := DebosContext{rootdir: rootdir, aptProxy: "http://proxy:3142"}
+	conf := path.Join(rootdir, aptProxyConf)
+
+	for _, failing := range []bool{false, true} {
+		err = withAptProxy(&context, func() error {
+			content, err := ioutil.ReadFile(conf)
+			if err != nil {
+				t.Errorf("No proxy configuration while apt runs: %v", err)
+			} else if !strings.Contains(string(content), "http://proxy:3142") {
+				t.Errorf("Proxy missing from the configuration: %s", content)
+			}
+			if failing {
+				return errors.New("apt failed")
+			}
+			return nil
+		})
+		if failing != (err != nil) {
+			t.Errorf("Got error %v, failing %v", err, failing)
+		}
+
+		if _, err := os.Stat(conf); !os.IsNotExist(err) {
+			t.Errorf("Proxy configuration left in the rootfs, failing %v", failing)
+		}
+	}
+}
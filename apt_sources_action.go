@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type AptSource struct {
+	Uri        string
+	Types      []string // deb and/or deb-src, defaults to deb
+	Suites     []string
+	Components []string
+}
+
+/* Writes the targets apt sources, either /etc/apt/sources.list or when a file
+ * is given /etc/apt/sources.list.d/<file>.list, and updates the package lists */
+type AptSourcesAction struct {
+	BaseAction `yaml:",inline"`
+	File       string
+	Sources    []AptSource
+}
+
+/* Suites like bookworm, bookworm-backports or bookworm/updates */
+var suiteRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*(/[a-z0-9.+-]+)*$`)
+
+func (as *AptSourcesAction) Verify(context *DebosContext) error {
+	if len(as.Sources) == 0 {
+		return errors.New("No apt sources given")
+	}
+
+	if strings.Contains(as.File, "/") {
+		return fmt.Errorf("Invalid sources file name %s", as.File)
+	}
+
+	for idx := range as.Sources {
+		s := &as.Sources[idx]
+		if s.Uri == "" {
+			return errors.New("Apt source without uri")
+		}
+		if len(s.Suites) == 0 {
+			return fmt.Errorf("Apt source %s without suites", s.Uri)
+		}
+		for _, suite := range s.Suites {
+			if !suiteRegexp.MatchString(suite) {
+				return fmt.Errorf("Invalid suite name %s for %s", suite, s.Uri)
+			}
+		}
+		if len(s.Types) == 0 {
+			s.Types = []string{"deb"}
+		}
+		for _, t := range s.Types {
+			if t != "deb" && t != "deb-src" {
+				return fmt.Errorf("Unknown source type %s for %s", t, s.Uri)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (as *AptSourcesAction) Run(context *DebosContext) error {
+	as.LogStart()
+	var content bytes.Buffer
+
+	for _, s := range as.Sources {
+		for _, t := range s.Types {
+			for _, suite := range s.Suites {
+				line := []string{t, s.Uri, suite}
+				line = append(line, s.Components...)
+				content.WriteString(strings.Join(line, " ") + "\n")
+			}
+		}
+	}
+
+	var target string
+	if as.File != "" {
+		target = path.Join(context.rootdir, "etc/apt/sources.list.d", as.File+".list")
+	} else {
+		target = path.Join(context.rootdir, "etc/apt/sources.list")
+	}
+
+	err := os.MkdirAll(path.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(target, content.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", target, err)
+	}
+
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	return withAptProxy(context, func() error {
+		return c.Run("apt", "apt-get", "update")
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* Sets the default entry, menu timeout and console of an installed
+ * systemd-boot (loader.conf on the ESP) or GRUB (/etc/default/grub, after
+ * which the configuration is regenerated). The default entry has to exist,
+ * so this goes after the kernels and entries are in place */
+type BootloaderConfigAction struct {
+	BaseAction  `yaml:",inline"`
+	Bootloader  string // systemd-boot or grub
+	Default     string // Entry id (glob) for systemd-boot, GRUB_DEFAULT for grub
+	Timeout     *int   // Seconds
+	ConsoleMode string // systemd-boot console-mode
+	Console     string // GRUB_TERMINAL, e.g. serial or console
+	Esp         string
+}
+
+var grubMenuEntryRegexp = regexp.MustCompile(`(?m)^\s*(menuentry|submenu)\s+'([^']*)'`)
+
+func newBootloaderConfigAction() *BootloaderConfigAction {
+	return &BootloaderConfigAction{Esp: "/boot/efi"}
+}
+
+func (bc *BootloaderConfigAction) Verify(context *DebosContext) error {
+	switch bc.Bootloader {
+	case "systemd-boot":
+		if bc.Console != "" {
+			return errors.New("console is only for grub, use consolemode")
+		}
+		switch bc.ConsoleMode {
+		case "", "0", "1", "2", "auto", "max", "keep":
+		default:
+			return fmt.Errorf("Invalid console mode %s", bc.ConsoleMode)
+		}
+	case "grub":
+		if bc.ConsoleMode != "" {
+			return errors.New("consolemode is only for systemd-boot, use console")
+		}
+	default:
+		return fmt.Errorf("Unknown bootloader %s", bc.Bootloader)
+	}
+
+	if bc.Timeout != nil && *bc.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout %d", *bc.Timeout)
+	}
+
+	return nil
+}
+
+/* Boot entry ids systemd-boot knows: type 1 entries and UKIs */
+func systemdBootEntries(esp string) ([]string, error) {
+	var ids []string
+	for _, pattern := range []string{"loader/entries/*.conf", "EFI/Linux/*.efi"} {
+		files, err := filepath.Glob(path.Join(esp, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			ids = append(ids, path.Base(f))
+		}
+	}
+	return ids, nil
+}
+
+func (bc *BootloaderConfigAction) systemdBoot(context *DebosContext) error {
+	esp := path.Join(context.rootdir, bc.Esp)
+	settings := make(map[string]string)
+
+	if bc.Default != "" {
+		ids, err := systemdBootEntries(esp)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, id := range ids {
+			if ok, _ := filepath.Match(bc.Default, id); ok {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("No boot entry matches %s, entries are %s", bc.Default,
+				strings.Join(ids, ", "))
+		}
+		settings["default"] = bc.Default
+	}
+	if bc.Timeout != nil {
+		settings["timeout"] = strconv.Itoa(*bc.Timeout)
+	}
+	if bc.ConsoleMode != "" {
+		settings["console-mode"] = bc.ConsoleMode
+	}
+
+	err := os.MkdirAll(path.Join(esp, "loader"), 0755)
+	if err != nil {
+		return err
+	}
+	return setLoaderConf(path.Join(esp, "loader/loader.conf"), settings)
+}
+
+/* Set (or replace) settings in loader.conf, keeping the others */
+func setLoaderConf(file string, settings map[string]string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Couldn't read loader.conf: %v", err)
+	}
+
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+	for _, key := range []string{"default", "timeout", "console-mode"} {
+		value, ok := settings[key]
+		if !ok {
+			continue
+		}
+		line := key + " " + value
+		replaced := false
+		for idx, l := range lines {
+			fields := strings.Fields(l)
+			if len(fields) > 0 && fields[0] == key {
+				lines[idx] = line
+				replaced = true
+			}
+		}
+		if !replaced {
+			lines = append(lines, line)
+		}
+	}
+
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+/* Set (or replace) shell variable assignments in /etc/default/grub */
+func setGrubDefaults(file string, settings map[string]string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't read grub defaults: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	for _, key := range []string{"GRUB_DEFAULT", "GRUB_TIMEOUT", "GRUB_TERMINAL"} {
+		value, ok := settings[key]
+		if !ok {
+			continue
+		}
+		line := fmt.Sprintf("%s=%s", key, strconv.Quote(value))
+		replaced := false
+		for idx, l := range lines {
+			if strings.HasPrefix(strings.TrimSpace(l), key+"=") {
+				lines[idx] = line
+				replaced = true
+			}
+		}
+		if !replaced {
+			lines = append(lines, line)
+		}
+	}
+
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+/* GRUB_DEFAULT is an index, saved, or a menu entry title, possibly below a
+ * submenu as "submenu>entry" */
+func checkGrubDefault(cfg, def string) error {
+	if def == "saved" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(cfg)
+	if err != nil {
+		return fmt.Errorf("Couldn't read grub.cfg: %v", err)
+	}
+	var titles []string
+	for _, m := range grubMenuEntryRegexp.FindAllStringSubmatch(string(content), -1) {
+		titles = append(titles, m[2])
+	}
+
+	for _, part := range strings.Split(def, ">") {
+		if n, err := strconv.Atoi(part); err == nil {
+			if n < 0 || n >= len(titles) {
+				return fmt.Errorf("GRUB has no entry %d", n)
+			}
+			continue
+		}
+		found := false
+		for _, t := range titles {
+			found = found || t == part
+		}
+		if !found {
+			return fmt.Errorf("GRUB has no entry %s", part)
+		}
+	}
+
+	return nil
+}
+
+func (bc *BootloaderConfigAction) grub(context *DebosContext) error {
+	settings := map[string]string{}
+	if bc.Default != "" {
+		settings["GRUB_DEFAULT"] = bc.Default
+	}
+	if bc.Timeout != nil {
+		settings["GRUB_TIMEOUT"] = strconv.Itoa(*bc.Timeout)
+	}
+	if bc.Console != "" {
+		settings["GRUB_TERMINAL"] = bc.Console
+	}
+
+	err := setGrubDefaults(path.Join(context.rootdir, "etc/default/grub"), settings)
+	if err != nil {
+		return err
+	}
+
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	err = c.Run("update-grub", "update-grub")
+	if err != nil {
+		return err
+	}
+
+	if bc.Default == "" {
+		return nil
+	}
+	return checkGrubDefault(path.Join(context.rootdir, "boot/grub/grub.cfg"), bc.Default)
+}
+
+func (bc *BootloaderConfigAction) Run(context *DebosContext) error {
+	bc.LogStart()
+	if bc.Bootloader == "grub" {
+		return bc.grub(context)
+	}
+	return bc.systemdBoot(context)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/* Actions populating an empty rootfs from scratch, independent of the
+ * distribution. The rest of the rootdir handling doesn't care how the rootfs
+ * came to be */
+type Bootstrapper interface {
+	Action
+	Bootstrap(context *DebosContext) error
+}
+
+func runBootstrap(b Bootstrapper, context *DebosContext) error {
+	b.Base().LogStart()
+
+	err := os.MkdirAll(context.rootdir, 0755)
+	if err != nil {
+		return fmt.Errorf("Couldn't create rootdir: %v", err)
+	}
+
+	return b.Bootstrap(context)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/* Sets file capabilities on binaries in the rootfs, for when the package
+ * postinst that would normally do so didn't run or got stripped */
+type CapabilitiesAction struct {
+	BaseAction   `yaml:",inline"`
+	Capabilities map[string]string // e.g. /bin/ping: cap_net_raw+ep
+}
+
+/* setcap text form, e.g. "cap_net_raw+ep" or "cap_net_admin,cap_net_raw=eip" */
+var capabilitiesRegexp = regexp.MustCompile(`^(cap_[a-z_]+(,cap_[a-z_]+)*|all)?[=+-][eip]*( +((cap_[a-z_]+(,cap_[a-z_]+)*|all)?[=+-][eip]*))*$`)
+
+func (ca *CapabilitiesAction) Verify(context *DebosContext) error {
+	if len(ca.Capabilities) == 0 {
+		return errors.New("No capabilities to set")
+	}
+
+	for f, c := range ca.Capabilities {
+		if !path.IsAbs(f) || strings.Contains(f, "..") {
+			return fmt.Errorf("Invalid path %s", f)
+		}
+		if !capabilitiesRegexp.MatchString(c) {
+			return fmt.Errorf("Invalid capabilities %s for %s", c, f)
+		}
+	}
+
+	return nil
+}
+
+func (ca *CapabilitiesAction) Run(context *DebosContext) error {
+	ca.LogStart()
+
+	for f := range ca.Capabilities {
+		_, err := os.Stat(path.Join(context.rootdir, f))
+		if err != nil {
+			return fmt.Errorf("Couldn't find %s: %v", f, err)
+		}
+		e, err := elf.Open(path.Join(context.rootdir, f))
+		if err != nil {
+			return fmt.Errorf("%s isn't an ELF binary: %v", f, err)
+		}
+		e.Close()
+	}
+
+	return setCapabilities(context.rootdir, ca.Capabilities)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* A checkpoint snapshots the rootfs as produced by all actions before it. On
+ * later runs where the configuration of those actions is unchanged, they are
+ * skipped and the rootfs is restored from the snapshot instead. Note that only
+ * the recipe configuration is hashed, not the content of referenced files. */
+type CheckpointAction struct {
+	BaseAction `yaml:",inline"`
+	File       string
+	inputs     string
+	restore    bool
+}
+
+func (cp *CheckpointAction) Verify(context *DebosContext) error {
+	if cp.File == "" {
+		return fmt.Errorf("Checkpoint without a file")
+	}
+	return nil
+}
+
+/* Keep ownership, permissions and xattrs (e.g. file capabilities and
+ * SELinux labels) exactly as they are in the rootfs */
+var checkpointTarOptions = []string{"--numeric-owner", "--same-permissions",
+	"--xattrs", "--xattrs-include=*"}
+
+func (cp *CheckpointAction) inputsFile(context *DebosContext) string {
+	return path.Join(context.artifactdir, cp.File+".inputs")
+}
+
+func (cp *CheckpointAction) Run(context *DebosContext) error {
+	cp.LogStart()
+	tarball := path.Join(context.artifactdir, cp.File)
+
+	if cp.restore {
+		log.Printf("Restoring rootfs from %s\n", tarball)
+		os.MkdirAll(context.rootdir, 0755)
+		cmdline := append([]string{"tar"}, checkpointTarOptions...)
+		cmdline = append(cmdline, "-x", "-z", "-f", tarball, "-C", context.rootdir)
+		return Command{}.Run("checkpoint", cmdline...)
+	}
+
+	/* Drop a stale hash first so a failure below can't leave an outdated
+	 * tarball looking valid */
+	os.Remove(cp.inputsFile(context))
+
+	err := os.MkdirAll(path.Dir(tarball), 0755)
+	if err != nil {
+		return err
+	}
+
+	cmdline := append([]string{"tar"}, checkpointTarOptions...)
+	cmdline = append(cmdline, "-c", "-z", "-f", tarball, "-C", context.rootdir, ".")
+	err = Command{}.Run("checkpoint", cmdline...)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cp.inputsFile(context), []byte(cp.inputs+"\n"), 0644)
+}
+
+func checkpointCovers(a Action) error {
+	switch action := a.(type) {
+	case *ImagePartitionAction, *FilesystemDeployAction, *OstreeDeployAction,
+		*RawAction:
+		return fmt.Errorf("Action `%s` can't be covered by a checkpoint", a)
+	case *RunAction:
+		if action.PostProcess {
+			return fmt.Errorf("Postprocess action `%s` can't be covered by a checkpoint", a)
+		}
+	}
+	return nil
+}
+
+/* Directory in the artifactdir for the snapshots taken with --resume */
+const resumeDir = ".debos-resume"
+
+/* For resumable builds every action up to the first one a checkpoint can't
+ * cover gets a checkpoint of its own after it, so a rerun restarts after the
+ * last action that succeeded with unchanged inputs before it */
+func addResumeCheckpoints(actions []YamlAction) []YamlAction {
+	var out []YamlAction
+	for idx, a := range actions {
+		if checkpointCovers(a.Action) != nil {
+			return append(out, actions[idx:]...)
+		}
+
+		out = append(out, a)
+		if _, ok := a.Action.(*CheckpointAction); ok {
+			continue
+		}
+
+		cp := &CheckpointAction{File: path.Join(resumeDir, fmt.Sprintf("%02d.tar.gz", idx))}
+		cp.Action = "checkpoint"
+		cp.Description = fmt.Sprintf("Resume point after %s", a)
+		out = append(out, YamlAction{cp})
+	}
+	return out
+}
+
+/* Compute the input hashes of all checkpoints and drop the actions covered by
+ * the last checkpoint which has an up to date snapshot */
+func resolveCheckpoints(context *DebosContext, actions []YamlAction) ([]YamlAction, error) {
+	h := sha256.New()
+	h.Write([]byte(context.Architecture))
+
+	start := 0
+	for idx, a := range actions {
+		cp, ok := a.Action.(*CheckpointAction)
+		if !ok {
+			if err := checkpointCovers(a.Action); err != nil {
+				/* Only matters if a checkpoint comes later */
+				for _, later := range actions[idx:] {
+					if _, ok := later.Action.(*CheckpointAction); ok {
+						return nil, err
+					}
+				}
+			}
+
+			config, err := yaml.Marshal(a.Action)
+			if err != nil {
+				return nil, err
+			}
+			h.Write(config)
+			continue
+		}
+
+		cp.inputs = hex.EncodeToString(h.Sum(nil))
+		current, err := ioutil.ReadFile(cp.inputsFile(context))
+		if err == nil && strings.TrimSpace(string(current)) == cp.inputs {
+			if _, err := os.Stat(path.Join(context.artifactdir, cp.File)); err == nil {
+				start = idx
+			}
+		}
+	}
+
+	if start == 0 {
+		return actions, nil
+	}
+
+	cp := actions[start].Action.(*CheckpointAction)
+	cp.restore = true
+	log.Printf("Checkpoint %s up to date, skipping %d actions\n", cp.File, start)
+
+	return actions[start:], nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+/* Populates a FAT partition of the image as a cloud-init seed, either a
+ * NoCloud one (label cidata) or an OpenStack config drive (label config-2),
+ * which also carries Ignition configs as user data. The seed partition has
+ * to be in the partitions of the image-partition action, with fs fat32, and
+ * as image-partition labels FAT partitions with their name, named after the
+ * label. The files are templated like the recipe */
+type CloudInitSeedAction struct {
+	BaseAction    `yaml:",inline"`
+	Partition     string
+	Format        string // nocloud or configdrive
+	UserData      string // Files relative to the recipe
+	MetaData      string
+	NetworkConfig string
+	InstanceId    string // Used for generated meta data
+}
+
+/* Where each file goes for the formats */
+var cloudInitSeedLayouts = map[string]struct {
+	label, userData, metaData, networkConfig string
+}{
+	"nocloud":     {"cidata", "user-data", "meta-data", "network-config"},
+	"configdrive": {"config-2", "openstack/latest/user_data", "openstack/latest/meta_data.json", "openstack/latest/network_data.json"},
+}
+
+func newCloudInitSeedAction() *CloudInitSeedAction {
+	return &CloudInitSeedAction{Format: "nocloud", InstanceId: "iid-debos"}
+}
+
+func (cs *CloudInitSeedAction) Verify(context *DebosContext) error {
+	layout, ok := cloudInitSeedLayouts[cs.Format]
+	if !ok {
+		return fmt.Errorf("Unknown seed format %s", cs.Format)
+	}
+
+	if cs.Partition == "" {
+		cs.Partition = layout.label
+	}
+	if cs.Partition != layout.label {
+		return fmt.Errorf("The %s seed partition has to be named %s to get the right label",
+			cs.Format, layout.label)
+	}
+
+	if context.imagePartitions == nil {
+		return errors.New("No image to seed, missing image-partition action?")
+	}
+	if _, ok := context.imagePartitions[cs.Partition]; !ok {
+		return fmt.Errorf("Unknown partition %s", cs.Partition)
+	}
+	for _, p := range context.imageLayout.Partitions {
+		if p.Name != cs.Partition {
+			continue
+		}
+		if p.FS != "fat32" && p.FS != "vfat" {
+			return fmt.Errorf("The seed partition %s needs a fat32 fs, not %q", p.Name, p.FS)
+		}
+		if p.Source != "" || p.NoFormat {
+			return fmt.Errorf("The seed partition %s has to be formatted to get its label", p.Name)
+		}
+	}
+
+	if cs.UserData == "" {
+		return errors.New("No user data given")
+	}
+	for _, f := range []string{cs.UserData, cs.MetaData, cs.NetworkConfig} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(CleanPathAt(f, context.recipeDir)); err != nil {
+			return fmt.Errorf("Couldn't find seed file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (cs *CloudInitSeedAction) render(context *DebosContext, file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(CleanPathAt(file, context.recipeDir))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := context.expandTemplate(path.Base(file), string(content))
+	return []byte(data), err
+}
+
+func (cs *CloudInitSeedAction) defaultMetaData() []byte {
+	if cs.Format == "configdrive" {
+		return []byte(fmt.Sprintf("{\"uuid\": \"%s\"}\n", cs.InstanceId))
+	}
+	return []byte(fmt.Sprintf("instance-id: %s\n", cs.InstanceId))
+}
+
+func (cs *CloudInitSeedAction) Run(context *DebosContext) error {
+	cs.LogStart()
+	layout := cloudInitSeedLayouts[cs.Format]
+
+	files := map[string][]byte{}
+	for dst, src := range map[string]string{
+		layout.userData:      cs.UserData,
+		layout.metaData:      cs.MetaData,
+		layout.networkConfig: cs.NetworkConfig,
+	} {
+		if src == "" {
+			continue
+		}
+		content, err := cs.render(context, src)
+		if err != nil {
+			return err
+		}
+		files[dst] = content
+	}
+	if _, ok := files[layout.metaData]; !ok {
+		files[layout.metaData] = cs.defaultMetaData()
+	}
+
+	mntpath, err := ioutil.TempDir(context.scratchdir, "seed-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mntpath)
+
+	dev := ImagePartitionAction{}.getPartitionDevice(context.imagePartitions[cs.Partition], *context)
+	err = syscall.Mount(dev, mntpath, "vfat", 0, "")
+	if err != nil {
+		return fmt.Errorf("%s mount failed: %v", cs.Partition, err)
+	}
+	defer unmount(mntpath, context.killBusy)
+
+	for name, content := range files {
+		dst := path.Join(mntpath, name)
+		err = os.MkdirAll(path.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(dst, content, 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't write %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 )
 
 type ChrootEnterMethod int
@@ -18,6 +19,21 @@ const (
 	CHROOT_METHOD_CHROOT        // use chroot to create the chroot environment
 )
 
+type OutputMode int
+
+const (
+	OUTPUT_NORMAL  OutputMode = iota // Relay all command output
+	OUTPUT_QUIET                     // Only show the tail of failed commands output
+	OUTPUT_VERBOSE                   // Also show the command lines
+)
+
+/* Lines of output kept for commands failing in quiet mode */
+var quietTailLines = 20
+
+/* Output mode as per -q/-v and the one of the action currently running */
+var defaultOutput OutputMode = OUTPUT_NORMAL
+var commandOutput OutputMode = OUTPUT_NORMAL
+
 type Command struct {
 	Architecture string            // Architecture of the chroot, nil if same as host
 	Dir          string            // Working dir to run command in
@@ -26,27 +42,65 @@ type Command struct {
 
 	bindMounts []string /// Items to bind mount
 	extraEnv   []string // Extra environment variables to set
+	sensitive  []string // Values to hide from the logs
+	stdin      *string  // Input of the command, none if nil
 }
 
 type commandWrapper struct {
-	label  string
-	buffer *bytes.Buffer
+	label     string
+	buffer    *bytes.Buffer
+	sensitive []string
+	quiet     bool
+	tail      *[]string
 }
 
-func newCommandWrapper(label string) *commandWrapper {
+func newCommandWrapper(label string, sensitive []string) *commandWrapper {
 	b := bytes.Buffer{}
-	return &commandWrapper{label, &b}
+	return &commandWrapper{label, &b, sensitive, commandOutput == OUTPUT_QUIET, &[]string{}}
+}
+
+func (w commandWrapper) log(line string) {
+	line = redactSensitive(line, w.sensitive)
+	if !w.quiet {
+		log.Printf("%s | %v", w.label, line)
+		return
+	}
+
+	*w.tail = append(*w.tail, line)
+	if len(*w.tail) > quietTailLines {
+		*w.tail = (*w.tail)[1:]
+	}
+}
+
+/* Show what quiet mode held back, for when the command failed */
+func (w *commandWrapper) showTail() {
+	if len(*w.tail) > 0 {
+		log.Printf("%s | last %d lines of output:", w.label, len(*w.tail))
+	}
+	for _, l := range *w.tail {
+		log.Printf("%s | %v", w.label, l)
+	}
+}
+
+/* Replace sensitive values, both the commands own and the recipe secrets */
+func redactSensitive(s string, sensitive []string) string {
+	for _, v := range sensitive {
+		if v != "" {
+			s = strings.Replace(s, v, "<redacted>", -1)
+		}
+	}
+	return redact(s)
 }
 
 func (w commandWrapper) out(atEOF bool) {
 	for {
 		s, err := w.buffer.ReadString('\n')
 		if err == nil {
-			log.Printf("%s | %v", w.label, s)
+			w.log(s)
 		} else {
 			if len(s) > 0 {
 				if atEOF && err == io.EOF {
-					log.Printf("%s | %v\n", w.label, s)
+					w.log(s + "\n")
 				} else {
 					w.buffer.WriteString(s)
 				}
@@ -78,6 +132,18 @@ func (cmd *Command) AddEnvKey(key, value string) {
 	cmd.extraEnv = append(cmd.extraEnv, fmt.Sprintf("%s=%s", key, value))
 }
 
+/* Mark a value, e.g. a password passed as argument or in the environment,
+ * to be shown as a placeholder whenever the command ends up in the logs */
+func (cmd *Command) AddSensitive(value string) {
+	cmd.sensitive = append(cmd.sensitive, value)
+}
+
+/* Feed input to the command. It's written from another goroutine while the
+ * output is being read, so any size works */
+func (cmd *Command) SetStdin(input string) {
+	cmd.stdin = &input
+}
+
 func (cmd *Command) AddBindMount(source, target string) {
 	var mount string
 	if target != "" {
@@ -111,13 +177,20 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 			options = append(options, "--bind", b)
 
 		}
+		/* Without a terminal nspawn doesn't pass on stdin otherwise */
+		if cmd.stdin != nil {
+			options = append(options, "--pipe")
+		}
 		options = append(options, cmdline...)
 	}
 
 	exe := exec.Command(options[0], options[1:]...)
-	w := newCommandWrapper(label)
+	w := newCommandWrapper(label, cmd.sensitive)
 
 	exe.Stdin = nil
+	if cmd.stdin != nil {
+		exe.Stdin = strings.NewReader(*cmd.stdin)
+	}
 	exe.Stdout = w
 	exe.Stderr = w
 
@@ -125,11 +198,24 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		exe.Env = append(os.Environ(), cmd.extraEnv...)
 	}
 
+	if commandOutput == OUTPUT_VERBOSE {
+		log.Printf("%s | $ %s", label, redactSensitive(strings.Join(options, " "), cmd.sensitive))
+	}
+
 	err := exe.Run()
 	w.flush()
 	q.Cleanup()
 
-	return err
+	if err != nil {
+		w.showTail()
+		return fmt.Errorf("%s failed: %v", redactSensitive(strings.Join(cmdline, " "), cmd.sensitive), err)
+	}
+
+	if w.quiet {
+		log.Printf("%s | %s done", label, path.Base(cmdline[0]))
+	}
+
+	return nil
 }
 
 type qemuHelper struct {
@@ -166,7 +252,7 @@ func (q qemuHelper) Setup() error {
 	if q.qemusrc == "" {
 		return nil
 	}
-	return CopyFile(q.qemusrc, q.qemutarget, 755)
+	return CopyFile(q.qemusrc, q.qemutarget, 0755)
 }
 
 func (q qemuHelper) Cleanup() {
@@ -1,9 +1,47 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestBasicCommand(t *testing.T) {
 	Command{}.Run("out", "ls", "-l")
 }
+
+func TestQuietCommand(t *testing.T) {
+	commandOutput = OUTPUT_QUIET
+	defer func() { commandOutput = OUTPUT_NORMAL }()
+
+	w := newCommandWrapper("quiet", nil)
+	for i := 0; i < quietTailLines+5; i++ {
+		w.Write([]byte("line\n"))
+	}
+	w.Write([]byte("last"))
+	w.flush()
+
+	if len(*w.tail) != quietTailLines {
+		t.Errorf("Kept %d lines instead of %d", len(*w.tail), quietTailLines)
+	}
+	if (*w.tail)[quietTailLines-1] != "last\n" {
+		t.Errorf("Tail misses the last line: %q", (*w.tail)[quietTailLines-1])
+	}
+
+	err := Command{}.Run("quiet", "sh", "-c", "echo failing; exit 1")
+	if err == nil {
+		t.Errorf("Failing command didn't fail")
+	}
+}
+
+func TestStdinCommand(t *testing.T) {
+	/* Well beyond what a pipe buffers */
+	input := strings.Repeat("0123456789abcde\n", 1<<16)
+
+	cmd := Command{}
+	cmd.SetStdin(input)
+	err := cmd.Run("stdin", "sh", "-c", fmt.Sprintf("test $(wc -c) -eq %d", len(input)))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* Values actions publish for later ones, say the path of a generated initrd,
+ * kept by key in the context. Templates expanded while the build runs see
+ * them through the value function; as the recipe itself gets expanded up
+ * front, value in the recipe is left in place for the actions expanding it
+ * again at run time; anywhere else it is an error. Values only live on one side of the fakemachine, so
+ * PostMachine stages don't see what was set inside it.
+ *
+ * Keys set by the built-in actions:
+ *
+ *  initrd                    initrd generated by initramfs, in the rootfs
+ *  image.file                the image file of image-partition
+ *  image.kernel-root         root= commandline snippet for the image
+ *  partition.NAME.fsuuid     filesystem uuid of partition NAME
+ *  partition.NAME.partuuid   gpt partition guid of partition NAME
+ *  recipe.OUTPUT             artifact OUTPUT built by a recipe action
+ *  uki                       unified kernel image built by uki, in the rootfs
+ *  partition.NAME.mountpoint where partition NAME is mounted in the image
+ *  verity.NAME.roothash      dm-verity root hash of partition NAME
+ *  verity.NAME.roothash-file artifact with the root hash of partition NAME
+ *  kernel.version            kernel exported by export-kernel
+ *  filesystem.FILE           filesystem image FILE to be built by filesystem
+ *  keyring.FILE              host keyring FILE written by gpg-import
+ */
+func (context *DebosContext) SetValue(key string, value interface{}) {
+	if context.values == nil {
+		context.values = make(map[string]interface{})
+	}
+	context.values[key] = value
+}
+
+func (context *DebosContext) Value(key string) (interface{}, bool) {
+	v, ok := context.values[key]
+	return v, ok
+}
+
+func (context *DebosContext) StringValue(key string) (string, error) {
+	v, ok := context.Value(key)
+	if !ok {
+		return "", fmt.Errorf("No value %s set", key)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("Value %s is a %T, not a string", key, v)
+	}
+	return s, nil
+}
+
+func (context *DebosContext) IntValue(key string) (int, error) {
+	v, ok := context.Value(key)
+	if !ok {
+		return 0, fmt.Errorf("No value %s set", key)
+	}
+	n, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("Value %s is a %T, not an int", key, v)
+	}
+	return n, nil
+}
+
+/* While expanding the recipe nothing is set yet, so leave the call for
+ * run time */
+func templateDeferredValue(key string) string {
+	return fmt.Sprintf("{{ value %q }}", key)
+}
+
+/* Actions expanding value calls at run time, in the fields returned */
+type valueExpander interface {
+	valueFields() []string
+}
+
+/* A value call left anywhere else would end up in the image as it is */
+func checkDeferredValues(a Action) error {
+	const call = "{{ value "
+
+	config, err := yaml.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	expanded := 0
+	if e, ok := a.(valueExpander); ok {
+		for _, f := range e.valueFields() {
+			expanded += strings.Count(f, call)
+		}
+	}
+	if strings.Count(string(config), call) > expanded {
+		return errors.New("value is only expanded in fields the action templates when running, " +
+			"e.g. the command of a run action with values set")
+	}
+
+	return nil
+}
+
+func (context *DebosContext) templateValue(key string) (interface{}, error) {
+	v, ok := context.Value(key)
+	if !ok {
+		return nil, fmt.Errorf("No value %s set", key)
+	}
+	return v, nil
+}
+
+/* Expand a template at run time, with the recipe functions and variables and
+ * the values set so far */
+func (context *DebosContext) expandTemplate(name, text string) (string, error) {
+	funcs := templateFuncs(context, context.templateExec)
+	funcs["value"] = context.templateValue
+
+	t := template.New(name)
+	t.Funcs(funcs)
+	_, err := t.Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't parse %s: %v", name, err)
+	}
+
+	data := new(bytes.Buffer)
+	err = t.Execute(data, context.templateVars)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't expand %s: %v", name, err)
+	}
+
+	return data.String(), nil
+}
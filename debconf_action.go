@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Preseeds debconf in the rootfs, so packages installed later (with apt
+ * running non-interactively anyway) take the answers instead of prompting or
+ * falling back to their defaults. Selections come from the recipe and/or a
+ * file in debconf-set-selections format */
+type DebconfAction struct {
+	BaseAction `yaml:",inline"`
+	Selections []DebconfSelection
+	File       string // Relative to the recipe
+}
+
+type DebconfSelection struct {
+	Package  string // Owner of the question, e.g. tzdata
+	Question string // e.g. tzdata/Areas
+	Type     string
+	Value    string
+}
+
+var debconfTypes = map[string]bool{
+	"string": true, "boolean": true, "select": true, "multiselect": true,
+	"note": true, "text": true, "password": true, "error": true, "title": true,
+}
+
+func (dc *DebconfAction) Verify(context *DebosContext) error {
+	if len(dc.Selections) == 0 && dc.File == "" {
+		return errors.New("No debconf selections given")
+	}
+
+	for _, s := range dc.Selections {
+		if s.Package == "" || s.Question == "" {
+			return errors.New("Debconf selection needs a package and question")
+		}
+		if !debconfTypes[s.Type] {
+			return fmt.Errorf("Debconf selection %s has unknown type %s", s.Question, s.Type)
+		}
+		if strings.Contains(s.Value, "\n") {
+			return fmt.Errorf("Debconf selection %s: value can't span lines", s.Question)
+		}
+	}
+
+	if dc.File != "" {
+		if _, err := os.Stat(CleanPathAt(dc.File, context.recipeDir)); err != nil {
+			return fmt.Errorf("Couldn't find selections file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (dc *DebconfAction) Run(context *DebosContext) error {
+	dc.LogStart()
+
+	var selections strings.Builder
+	if dc.File != "" {
+		content, err := ioutil.ReadFile(CleanPathAt(dc.File, context.recipeDir))
+		if err != nil {
+			return fmt.Errorf("Couldn't read selections file: %v", err)
+		}
+		selections.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			selections.WriteString("\n")
+		}
+	}
+	for _, s := range dc.Selections {
+		selections.WriteString(fmt.Sprintf("%s %s %s %s\n", s.Package, s.Question, s.Type, s.Value))
+	}
+
+	/* debconf-set-selections runs in the rootfs, so the input has to be
+	 * in there for the time being; not in /tmp, which nspawn mounts a tmpfs
+	 * over */
+	tmp, err := ioutil.TempFile(path.Join(context.rootdir, "var/tmp"), "debos-debconf-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(selections.String())
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	return c.Run("debconf", "debconf-set-selections",
+		path.Join("/var/tmp", path.Base(tmp.Name())))
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -15,6 +17,29 @@ type DebootstrapAction struct {
 	Variant        string
 	KeyringPackage string
 	Components     []string
+	MergedUsr      bool
+	Keyrings       []string // Keys to trust, installed to trusted.gpg.d
+	Secure         bool     // Check signatures while bootstrapping and after
+}
+
+func newDebootstrapAction() *DebootstrapAction {
+	d := &DebootstrapAction{}
+	/* Use merged-usr by default, as debos always has */
+	d.MergedUsr = true
+	return d
+}
+
+func (d *DebootstrapAction) Verify(context *DebosContext) error {
+	err := checkKeyrings(context, d.Keyrings)
+	if err != nil {
+		return err
+	}
+
+	if d.Secure && d.KeyringPackage == "" && len(d.Keyrings) == 0 {
+		return errors.New("Secure debootstrap needs a keyring to check the mirror against")
+	}
+
+	return nil
 }
 
 func (d *DebootstrapAction) RunSecondStage(context DebosContext) error {
@@ -36,9 +61,37 @@ func (d *DebootstrapAction) RunSecondStage(context DebosContext) error {
 }
 
 func (d *DebootstrapAction) Run(context *DebosContext) error {
-	d.LogStart()
-	cmdline := []string{"debootstrap", "--no-check-gpg",
-		"--merged-usr"}
+	return runBootstrap(d, context)
+}
+
+func (d *DebootstrapAction) Bootstrap(context *DebosContext) error {
+	cmdline := []string{"debootstrap"}
+
+	switch {
+	case !d.Secure:
+		cmdline = append(cmdline, "--no-check-gpg")
+	case d.KeyringPackage == "":
+		/* debootstrap takes a single keyring, any of the keys may have
+		 * signed the archive */
+		tmp, err := ioutil.TempDir(context.scratchdir, "keyring-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		keyring := path.Join(tmp, "keyring.gpg")
+		err = mergeKeyrings(context, d.Keyrings, keyring)
+		if err != nil {
+			return err
+		}
+		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", keyring))
+	}
+
+	if d.MergedUsr {
+		cmdline = append(cmdline, "--merged-usr")
+	} else {
+		cmdline = append(cmdline, "--no-merged-usr")
+	}
 
 	if d.KeyringPackage != "" {
 		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", d.KeyringPackage))
@@ -67,7 +120,9 @@ func (d *DebootstrapAction) Run(context *DebosContext) error {
 	cmdline = append(cmdline, d.Mirror)
 	cmdline = append(cmdline, "/usr/share/debootstrap/scripts/unstable")
 
-	err := Command{}.Run("Debootstrap", cmdline...)
+	bootstrap := Command{}
+	addProxyEnv(context, &bootstrap)
+	err := bootstrap.Run("Debootstrap", cmdline...)
 
 	if err != nil {
 		return err
@@ -95,6 +150,11 @@ func (d *DebootstrapAction) Run(context *DebosContext) error {
 	}
 	srclist.Close()
 
+	err = setupAptTrust(context, d.Keyrings, d.Secure)
+	if err != nil {
+		return err
+	}
+
 	c := NewChrootCommand(context.rootdir, context.Architecture)
 
 	return c.Run("apt clean", "/usr/bin/apt-get", "clean")
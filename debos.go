@@ -2,14 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/debos/fakemachine"
@@ -17,6 +26,9 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+/* Set at build time with -ldflags "-X main.Version=..." */
+var Version = "unknown"
+
 func CleanPathAt(path, at string) string {
 	if filepath.IsAbs(path) {
 		return filepath.Clean(path)
@@ -30,6 +42,79 @@ func CleanPath(path string) string {
 	return CleanPathAt(path, cwd)
 }
 
+/* Check a rootdir override of an action, a directory inside the rootfs such
+ * as a nested OSTree deployment */
+func checkSubRootdir(subdir string) error {
+	if subdir == "" {
+		return nil
+	}
+
+	clean := filepath.Clean(subdir)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("rootdir %s isn't a relative path inside the rootfs", subdir)
+	}
+
+	return nil
+}
+
+/* Directory an action works in, the rootfs or the given subdirectory of it.
+ * Symlinks are resolved so the result can't point outside of the rootfs */
+func (context *DebosContext) subRootdir(subdir string) (string, error) {
+	if subdir == "" {
+		return context.rootdir, nil
+	}
+
+	root, err := filepath.EvalSymlinks(context.rootdir)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, subdir))
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find rootdir %s: %v", subdir, err)
+	}
+	if dir != root && !strings.HasPrefix(dir, root+"/") {
+		return "", fmt.Errorf("rootdir %s is outside of the rootfs", subdir)
+	}
+
+	return dir, nil
+}
+
+/* File in the rootfs the way it's found from inside: symlinks on the way,
+ * absolute ones included, are followed within the rootfs rather than out of
+ * it onto the host */
+func rootfsPath(rootdir, file string) (string, error) {
+	resolved := "/"
+	pending := strings.Split(path.Clean("/"+file), "/")
+	links := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		if c == "" {
+			continue
+		}
+
+		next := path.Join(resolved, c)
+		target, err := os.Readlink(path.Join(rootdir, next))
+		if err != nil {
+			/* Not a symlink, or not there yet */
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 40 {
+			return "", fmt.Errorf("Too many levels of symlinks in %s", file)
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		pending = append(strings.Split(path.Clean(target), "/"), pending...)
+		resolved = "/"
+	}
+
+	return path.Join(rootdir, resolved), nil
+}
+
 func CopyFile(src, dst string, mode os.FileMode) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -57,6 +142,43 @@ func CopyFile(src, dst string, mode os.FileMode) error {
 	return os.Rename(tmp.Name(), dst)
 }
 
+/* Extended attributes, which include file capabilities and security labels.
+ * Attributes the destination filesystem doesn't support are skipped */
+func copyXattrs(src, dst string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(src, buf)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, err := syscall.Getxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		vsize, err = syscall.Getxattr(src, name, value)
+		if err != nil {
+			return err
+		}
+
+		err = syscall.Setxattr(dst, name, value[:vsize], 0)
+		if err == syscall.ENOTSUP {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't set %s on %s: %v", name, dst, err)
+		}
+	}
+
+	return nil
+}
+
 func CopyTree(sourcetree, desttree string) error {
 	fmt.Printf("Overlaying %s on %s\n", sourcetree, desttree)
 	walker := func(p string, info os.FileInfo, err error) error {
@@ -70,8 +192,10 @@ func CopyTree(sourcetree, desttree string) error {
 		switch info.Mode() & os.ModeType {
 		case 0:
 			CopyFile(p, target, info.Mode())
+			return copyXattrs(p, target)
 		case os.ModeDir:
 			os.Mkdir(target, info.Mode())
+			return copyXattrs(p, target)
 		case os.ModeSymlink:
 			link, err := os.Readlink(p)
 			if err != nil {
@@ -93,10 +217,24 @@ type DebosContext struct {
 	rootdir         string
 	artifactdir     string
 	image           string
+	imageFile       string         // Image file as named in the recipe
+	imagePartitions map[string]int // Partition numbers by name
+	imageLayout     *ImagePartitionAction
 	imageMntDir     string
 	imageFSTab      bytes.Buffer // Fstab as per partitioning
 	imageKernelRoot string       // Kernel cmdline root= snippet for the / of the image
 	recipeDir       string
+	rootOverlay     string // Mountpoint of the staging overlay, if any
+	killBusy        bool   // Kill processes keeping mounts busy on cleanup
+	strict          bool   // Treat recipe warnings as errors
+	linting         bool   // Only checking the recipe, so Verify runs nothing
+	allowWipe       bool   // Recipes may wipe signatures off the image
+	secrets         map[string]string
+	templateVars    map[string]string // Recipe template variables
+	templateExec    bool              // Templates may use exec
+	values          map[string]interface{}
+	recipeSha256    string // Of the recipe as read, before templating
+	aptProxy        string // Proxy for fetching packages during the build only
 	Architecture    string
 }
 
@@ -109,11 +247,37 @@ type Action interface {
 	Cleanup(context DebosContext) error
 	PostMachine(context DebosContext) error
 	String() string
+	Base() *BaseAction
 }
 
 type BaseAction struct {
 	Action      string
 	Description string
+	Name        string
+	DependsOn   []string `yaml:"depends_on"`
+	Quiet       bool     // Only show command output on failure
+	Verbose     bool     // Show command lines as well
+}
+
+/* The actions own output mode, if it has one, overrides the global one */
+func (b *BaseAction) outputMode() OutputMode {
+	switch {
+	case b.Quiet:
+		return OUTPUT_QUIET
+	case b.Verbose:
+		return OUTPUT_VERBOSE
+	}
+	return defaultOutput
+}
+
+/* Log a warning about the recipe, or fail in strict mode */
+func (context *DebosContext) Warn(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if context.strict {
+		return errors.New(msg)
+	}
+	log.Printf("Warning: %s\n", msg)
+	return nil
 }
 
 func (b *BaseAction) LogStart() {
@@ -136,6 +300,7 @@ func (b *BaseAction) String() string {
 	}
 	return b.Description
 }
+func (b *BaseAction) Base() *BaseAction { return b }
 
 /* the YamlAction just embed the Action interface and implements the
  * UnmarshalYAML function so it can select the concrete implementer of a
@@ -145,24 +310,35 @@ type YamlAction struct {
 }
 
 func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var aux BaseAction
+	/* Only the type is needed to pick the action, and a map takes any keys
+	 * when decoding strictly */
+	var aux map[string]interface{}
 
 	err := unmarshal(&aux)
 	if err != nil {
 		return err
 	}
+	action, _ := aux["action"].(string)
 
-	switch aux.Action {
+	switch action {
 	case "debootstrap":
-		y.Action = &DebootstrapAction{}
+		y.Action = newDebootstrapAction()
+	case "pacman-bootstrap":
+		y.Action = &PacmanBootstrapAction{}
+	case "from-tarball":
+		y.Action = &FromTarballAction{}
 	case "pack":
 		y.Action = &PackAction{}
+	case "pack-oci":
+		y.Action = newPackOCIAction()
 	case "unpack":
 		y.Action = &UnpackAction{}
 	case "run":
 		y.Action = &RunAction{}
 	case "apt":
 		y.Action = &AptAction{}
+	case "apt-sources":
+		y.Action = &AptSourcesAction{}
 	case "ostree-commit":
 		y.Action = &OstreeCommitAction{}
 	case "ostree-deploy":
@@ -175,30 +351,293 @@ func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		y.Action = newFilesystemDeployAction()
 	case "raw":
 		y.Action = &RawAction{}
+	case "user":
+		y.Action = &UserAction{}
+	case "systemd":
+		y.Action = &SystemdAction{}
+	case "write-file":
+		y.Action = &WriteFileAction{}
+	case "patch":
+		y.Action = newPatchAction()
+	case "checkpoint":
+		y.Action = &CheckpointAction{}
+	case "stage-overlay":
+		y.Action = &StageOverlayAction{}
+	case "usrmerge":
+		y.Action = &UsrMergeAction{}
+	case "initramfs":
+		y.Action = newInitramfsAction()
+	case "sign":
+		y.Action = &SignAction{}
+	case "locale":
+		y.Action = &LocaleAction{}
+	case "timezone":
+		y.Action = &TimezoneAction{}
+	case "keyboard":
+		y.Action = newKeyboardAction()
+	case "slim":
+		y.Action = &SlimAction{}
+	case "strip":
+		y.Action = &StripAction{}
+	case "os-release":
+		y.Action = newOsReleaseAction()
+	case "smoke-test":
+		y.Action = newSmokeTestAction()
+	case "network":
+		y.Action = newNetworkAction()
+	case "capabilities":
+		y.Action = &CapabilitiesAction{}
+	case "efi-fallback":
+		y.Action = newEfiFallbackAction()
+	case "filesystem-image":
+		y.Action = &FilesystemImageAction{}
+	case "fstab":
+		y.Action = &FstabAction{}
+	case "gpg-import":
+		y.Action = &GpgImportAction{}
+	case "cloud-init-seed":
+		y.Action = newCloudInitSeedAction()
+	case "pack-iso":
+		y.Action = newPackIsoAction()
+	case "selinux-relabel":
+		y.Action = &SELinuxRelabelAction{}
+	case "apparmor":
+		y.Action = &AppArmorAction{}
+	case "disk-usage":
+		y.Action = newDiskUsageAction()
+	case "recipe":
+		y.Action = &RecipeAction{}
+	case "uki":
+		y.Action = &UkiAction{}
+	case "verity":
+		y.Action = &VerityAction{}
+	case "grow-root":
+		y.Action = newGrowRootAction()
+	case "repart":
+		y.Action = &ImagePartitionAction{Backend: "repart"}
+	case "sbom":
+		y.Action = newSbomAction()
+	case "bootloader-config":
+		y.Action = newBootloaderConfigAction()
+	case "debconf":
+		y.Action = &DebconfAction{}
+	case "export-kernel":
+		y.Action = &ExportKernelAction{}
+	case "filesystem":
+		y.Action = newFilesystemAction()
+	case "image-version":
+		y.Action = newImageVersionAction()
+	case "dedup":
+		y.Action = newDedupAction()
+	case "zram":
+		y.Action = newZramAction()
 	default:
-		log.Fatalf("Unknown action: %v", aux.Action)
-	}
+		plugin, ok := findPlugin(action)
+		if !ok {
+			/* As a type error decoding goes on, so lint finds all of them */
+			return &yaml.TypeError{Errors: []string{fmt.Sprintf("Unknown action: %v", action)}}
+		}
+		p := &PluginAction{plugin: plugin, settings: aux}
+		y.Action = p
 
-	unmarshal(y.Action)
+		/* Plugins take any settings, so only pick the common ones out */
+		raw, err := yaml.Marshal(aux)
+		if err != nil {
+			return err
+		}
+		return yaml.Unmarshal(raw, &p.BaseAction)
+	}
 
-	return nil
+	return unmarshal(y.Action)
 }
 
-func sector(s int) int {
+/* Sectors are 512 bytes unless the size is given, e.g. sector 8 4096 */
+func sector(s int, size ...int) int {
+	if len(size) > 0 {
+		return s * size[0]
+	}
 	return s * 512
 }
 
 type Recipe struct {
 	Architecture string
+	Secrets      map[string]Secret
 	Actions      []YamlAction
 }
 
+/* Strictly keys that don't belong to the recipe or its actions are errors
+ * rather than ignored, as a misspelled key silently changes the build */
+func parseRecipe(data []byte, strict bool) (Recipe, error) {
+	r := Recipe{}
+
+	var err error
+	if strict {
+		err = yaml.UnmarshalStrict(data, &r)
+	} else {
+		err = yaml.Unmarshal(data, &r)
+	}
+
+	return r, err
+}
+
+/* Order the actions so every action comes after the ones it depends on.
+ * Otherwise the recipe order is kept, so recipes without dependencies run
+ * exactly as listed */
+func sortActions(actions []YamlAction) ([]YamlAction, error) {
+	names := make(map[string]int)
+	for idx, a := range actions {
+		name := a.Base().Name
+		if name == "" {
+			continue
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("Duplicate action name %s", name)
+		}
+		names[name] = idx
+	}
+
+	pending := make([]int, len(actions))
+	dependents := make([][]int, len(actions))
+	for idx, a := range actions {
+		for _, d := range a.Base().DependsOn {
+			dep, ok := names[d]
+			if !ok {
+				return nil, fmt.Errorf("Action `%s` depends on unknown action %s", a, d)
+			}
+			pending[idx]++
+			dependents[dep] = append(dependents[dep], idx)
+		}
+	}
+
+	sorted := make([]YamlAction, 0, len(actions))
+	done := make([]bool, len(actions))
+	for len(sorted) < len(actions) {
+		next := -1
+		for idx := range actions {
+			if !done[idx] && pending[idx] == 0 {
+				next = idx
+				break
+			}
+		}
+		if next < 0 {
+			return nil, errors.New("Dependency cycle between actions")
+		}
+
+		done[next] = true
+		sorted = append(sorted, actions[next])
+		for _, d := range dependents[next] {
+			pending[d]--
+		}
+	}
+
+	return sorted, nil
+}
+
+func isRemoteRecipe(file string) bool {
+	return strings.HasPrefix(file, "https://") || strings.HasPrefix(file, "http://")
+}
+
+/* Read the (untemplated) recipe from a file, stdin ("-") or a URL. When a
+ * sha256 checksum is given the content has to match it */
+func readRecipe(file, checksum string) ([]byte, error) {
+	var content []byte
+	var err error
+
+	switch {
+	case file == "-":
+		content, err = ioutil.ReadAll(os.Stdin)
+	case isRemoteRecipe(file):
+		var resp *http.Response
+		resp, err = http.Get(file)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed to fetch %s: %s", file, resp.Status)
+		}
+		content, err = ioutil.ReadAll(resp.Body)
+	default:
+		content, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum != "" {
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+			return nil, fmt.Errorf("Checksum mismatch for recipe %s", file)
+		}
+	}
+
+	return content, nil
+}
+
+/* Undone when debos exits, failing or not; log.Fatal would skip defers */
+var exitHandlers []func()
+
+func atExit(f func()) {
+	exitHandlers = append(exitHandlers, f)
+}
+
+func runExitHandlers() {
+	for idx := len(exitHandlers) - 1; idx >= 0; idx-- {
+		exitHandlers[idx]()
+	}
+	exitHandlers = nil
+}
+
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	runExitHandlers()
+	os.Exit(1)
+}
+
 func bailOnError(err error, a Action, stage string) {
 	if err == nil {
 		return
 	}
 
-	log.Fatalf("Action `%s` failed at stage %s, error: %s", a, stage, err)
+	report.finish("failed")
+	fatalf("Action `%s` failed at stage %s, error: %s", a, stage, err)
+}
+
+/* Run a stage of an action, recording it in the report */
+func doStage(a Action, stage string, f func() error) error {
+	commandOutput = a.Base().outputMode()
+	defer func() { commandOutput = defaultOutput }()
+
+	start := time.Now()
+	err := f()
+	report.addStage(a, stage, time.Since(start), err)
+	return err
+}
+
+func runStage(a Action, stage string, f func() error) {
+	bailOnError(doStage(a, stage, f), a, stage)
+}
+
+func logBuildState(context *DebosContext) {
+	log.Printf("rootfs: %s, scratch: %s", context.rootdir, context.scratchdir)
+	if context.imageMntDir != "" {
+		log.Printf("image: %s mounted at %s", context.image, context.imageMntDir)
+	}
+}
+
+/* Interactive shell in the environment a failed action left behind, the
+ * build carries on with cleaning up once it exits */
+func debugShell(context *DebosContext) {
+	log.Printf("Starting debug shell, exit it to clean up and stop the build")
+	logBuildState(context)
+
+	shell := exec.Command("/bin/sh")
+	shell.Dir = context.rootdir
+	shell.Env = append(os.Environ(), "ROOTDIR="+context.rootdir, "PS1=debos-debug# ")
+	shell.Stdin = os.Stdin
+	shell.Stdout = os.Stdout
+	shell.Stderr = os.Stderr
+	shell.Run()
 }
 
 func main() {
@@ -206,7 +645,31 @@ func main() {
 	var options struct {
 		ArtifactDir   string            `long:"artifactdir"`
 		InternalImage string            `long:"internal-image" hidden:"true"`
+		Secrets       string            `long:"internal-secrets" hidden:"true"`
+		Expanded      string            `long:"internal-expanded-recipe" hidden:"true"`
+		RecipeDir     string            `long:"recipe-dir" description:"Directory to resolve relative recipe paths against"`
+		Checksum      string            `long:"recipe-checksum" description:"Expected sha256 of the recipe"`
 		TemplateVars  map[string]string `short:"t" long:"template-var" description:"Template variables"`
+		TemplateExec  bool              `long:"template-exec" description:"Allow the exec template function"`
+		KillBusy      bool              `long:"kill-busy" description:"Kill processes keeping mounts busy at cleanup"`
+		Strict        bool              `long:"strict" description:"Fail on recipe warnings"`
+		ScratchDir    string            `long:"scratchdir" description:"Directory to use for staging"`
+		ScratchTmpfs  string            `long:"scratch-tmpfs-size" description:"Mount a tmpfs of the given size for staging"`
+		ArchMatrix    string            `long:"arch-matrix" description:"Comma separated architectures to build the recipe for"`
+		Report        string            `long:"report" description:"Write a JSON build report to the given file"`
+		DebugShell    bool              `long:"debug-shell" description:"Open a shell when an action fails, before cleaning up"`
+		KeepOnFailure bool              `long:"keep-on-failure" description:"Skip cleaning up when an action fails"`
+		Volumes       []string          `long:"volume" description:"Share a host directory with the machine, as host[:target][:ro]"`
+		AllowWipe     bool              `long:"allow-wipe" description:"Allow recipes to wipe existing signatures off the image"`
+		Umask         string            `long:"umask" default:"022" description:"Umask for files and directories created during the build"`
+		Quiet         bool              `short:"q" long:"quiet" description:"Only show the output of commands that fail"`
+		Verbose       bool              `short:"v" long:"verbose" description:"Show the commands being run"`
+		QuietLines    int               `long:"quiet-lines" default:"20" description:"Lines of output to show for commands failing quietly"`
+		PluginDirs    []string          `long:"plugin-dir" description:"Directory to look for action plugins in"`
+		AllowUnknown  bool              `long:"allow-unknown-keys" description:"Ignore recipe keys debos doesn't know"`
+		Resume        bool              `long:"resume" description:"Snapshot the rootfs after each action and resume from the last unchanged one"`
+		AptProxy      string            `long:"apt-proxy" description:"HTTP proxy for fetching packages, not kept in the image"`
+		LogFile       string            `long:"logfile" description:"Write the output to the given file as well"`
 	}
 
 	parser := flags.NewParser(&options, flags.Default)
@@ -222,28 +685,171 @@ func main() {
 		}
 	}
 
+	if options.LogFile != "" {
+		os.Exit(runLogged(CleanPath(options.LogFile)))
+	}
+
+	/* debos lint RECIPE only checks the recipe */
+	lint := len(args) == 2 && args[0] == "lint"
+	if lint {
+		args = args[1:]
+	}
+
+	/* debos manifest MANIFEST builds the recipes it lists */
+	if len(args) == 2 && args[0] == "manifest" {
+		artifactdir := options.ArtifactDir
+		if artifactdir == "" {
+			artifactdir, _ = os.Getwd()
+		}
+		report := options.Report
+		if report != "" {
+			report = CleanPath(report)
+		}
+		os.Exit(runManifest(args[1], CleanPath(artifactdir), report))
+	}
+
 	if len(args) != 1 {
 		log.Fatal("No recipe given!")
 	}
 
+	for _, d := range options.PluginDirs {
+		pluginDirs = append(pluginDirs, CleanPath(d))
+	}
+
+	if lint {
+		file := args[0]
+		context.recipeDir, _ = os.Getwd()
+		if file != "-" && !isRemoteRecipe(file) {
+			file = CleanPath(file)
+			context.recipeDir = path.Dir(file)
+		}
+		if options.RecipeDir != "" {
+			context.recipeDir = CleanPath(options.RecipeDir)
+		}
+		context.artifactdir = CleanPath(options.ArtifactDir)
+		context.templateVars = options.TemplateVars
+		context.templateExec = options.TemplateExec
+		os.Exit(lintMain(&context, file))
+	}
+
+	if options.ArchMatrix != "" {
+		if args[0] == "-" {
+			log.Fatal("Can't build an architecture matrix from stdin")
+		}
+		artifactdir := options.ArtifactDir
+		if artifactdir == "" {
+			artifactdir, _ = os.Getwd()
+		}
+		os.Exit(runMatrix(strings.Split(options.ArchMatrix, ","), CleanPath(artifactdir)))
+	}
+
+	/* Don't let the umask of whoever runs debos leak into the image */
+	umask, err := strconv.ParseUint(options.Umask, 8, 32)
+	if err != nil || umask > 0777 {
+		log.Fatalf("Invalid umask %s", options.Umask)
+	}
+	syscall.Umask(int(umask))
+
+	switch {
+	case options.Quiet && options.Verbose:
+		log.Fatal("Only one of --quiet and --verbose can be used")
+	case options.Quiet:
+		defaultOutput = OUTPUT_QUIET
+	case options.Verbose:
+		defaultOutput = OUTPUT_VERBOSE
+	}
+	commandOutput = defaultOutput
+	if options.QuietLines < 0 {
+		log.Fatalf("Invalid --quiet-lines %d", options.QuietLines)
+	}
+	quietTailLines = options.QuietLines
+
+	var volumes []volume
+	for _, spec := range options.Volumes {
+		v, err := parseVolume(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		volumes = append(volumes, v)
+	}
+
 	file := args[0]
-	file = CleanPath(file)
+	if file != "-" && !isRemoteRecipe(file) {
+		file = CleanPath(file)
+	}
+
+	recipe, err := readRecipe(file, options.Checksum)
+	if err != nil {
+		log.Fatalf("Couldn't read recipe: %v", err)
+	}
+	recipeSum := sha256.Sum256(recipe)
+	context.recipeSha256 = hex.EncodeToString(recipeSum[:])
 
 	/* If fakemachine is supported the outer fake machine will never use the
 	 * scratchdir, so just set it to /scrach as a dummy to prevent the outer
 	 * debos createing a temporary direction */
 	if fakemachine.InMachine() || fakemachine.Supported() {
 		context.scratchdir = "/scratch"
+		/* A host scratch directory is shared with the machine at the same
+		 * path, builds get their own directory in it */
+		if fakemachine.InMachine() && options.ScratchDir != "" {
+			context.scratchdir, err = ioutil.TempDir(options.ScratchDir, ".debos-")
+			if err != nil {
+				fatalf("Couldn't create scratch directory: %v", err)
+			}
+			scratch := context.scratchdir
+			atExit(func() { os.RemoveAll(scratch) })
+		}
 	} else {
 		log.Printf("fakemachine not supported, running on the host!")
-		cwd, _ := os.Getwd()
-		context.scratchdir, err = ioutil.TempDir(cwd, ".debos-")
-		defer os.RemoveAll(context.scratchdir)
+		base := options.ScratchDir
+		if base == "" {
+			base, _ = os.Getwd()
+		}
+		context.scratchdir, err = ioutil.TempDir(base, ".debos-")
+		if err != nil {
+			fatalf("Couldn't create scratch directory: %v", err)
+		}
+		scratch := context.scratchdir
+		atExit(func() { os.RemoveAll(scratch) })
+	}
+
+	if options.ScratchTmpfs != "" && (fakemachine.InMachine() || !fakemachine.Supported()) {
+		if mountScratchTmpfs(context.scratchdir, options.ScratchTmpfs) {
+			scratch := context.scratchdir
+			atExit(func() { unmount(scratch, true) })
+		}
+	}
+
+	for _, v := range volumes {
+		switch {
+		case fakemachine.InMachine():
+			err = v.mount()
+			if err != nil {
+				fatalf("%v", err)
+			}
+		case !fakemachine.Supported() && (v.target != v.host || v.readOnly):
+			log.Printf("Warning: no machine, using volume %s in place", v.host)
+		}
 	}
 
 	context.rootdir = path.Join(context.scratchdir, "root")
 	context.image = options.InternalImage
-	context.recipeDir = path.Dir(file)
+	context.killBusy = options.KillBusy
+	context.strict = options.Strict
+	context.allowWipe = options.AllowWipe
+	context.templateVars = options.TemplateVars
+	context.templateExec = options.TemplateExec
+	context.aptProxy = options.AptProxy
+	switch {
+	case options.RecipeDir != "":
+		context.recipeDir = CleanPath(options.RecipeDir)
+	case file == "-" || isRemoteRecipe(file):
+		/* No directory to speak of, resolve relative to where we are */
+		context.recipeDir, _ = os.Getwd()
+	default:
+		context.recipeDir = path.Dir(file)
+	}
 
 	context.artifactdir = options.ArtifactDir
 	if context.artifactdir == "" {
@@ -251,35 +857,74 @@ func main() {
 	}
 	context.artifactdir = CleanPath(context.artifactdir)
 
-	t := template.New(path.Base(file))
-	funcs := template.FuncMap{
-		"sector": sector,
-	}
-	t.Funcs(funcs)
-
-	_, err = t.ParseFiles(file)
-	if err != nil {
-		panic(err)
+	if options.Report != "" {
+		report = newBuildReport(CleanPath(options.Report), file, options.TemplateVars, &context)
 	}
 
+	/* The machine gets the recipe as expanded on the host, so env and exec
+	 * are evaluated once and in the environment debos was started in */
 	data := new(bytes.Buffer)
-	err = t.Execute(data, options.TemplateVars)
-	if err != nil {
-		panic(err)
+	if options.Expanded != "" {
+		expanded, err := ioutil.ReadFile(options.Expanded)
+		if err != nil {
+			fatalf("Couldn't read expanded recipe: %v", err)
+		}
+		data.Write(expanded)
+	} else {
+		t := template.New(path.Base(file))
+		t.Funcs(templateFuncs(&context, options.TemplateExec))
+
+		_, err = t.Parse(string(recipe))
+		if err != nil {
+			panic(err)
+		}
+
+		err = t.Execute(data, options.TemplateVars)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	r := Recipe{}
+	r, err := parseRecipe(data.Bytes(), !options.AllowUnknown)
+	if _, ok := err.(*yaml.TypeError); ok && !options.AllowUnknown {
+		fatalf("Invalid recipe: %v\n(--allow-unknown-keys ignores unknown keys)", err)
+	} else if err != nil {
+		fatalf("Invalid recipe: %v", err)
+	}
 
-	err = yaml.Unmarshal(data.Bytes(), &r)
+	r.Actions, err = sortActions(r.Actions)
 	if err != nil {
-		panic(err)
+		fatalf("Invalid recipe: %v", err)
 	}
 
 	context.Architecture = r.Architecture
 
+	if options.Secrets != "" {
+		context.secrets, err = readSecrets(options.Secrets)
+	} else {
+		context.secrets, err = resolveSecrets(r.Secrets, context.recipeDir)
+	}
+	if err != nil {
+		fatalf("Couldn't get secrets: %v", err)
+	}
+
 	for _, a := range r.Actions {
-		err = a.Verify(&context)
-		bailOnError(err, a, "Verify")
+		runStage(a, "Verify", func() error {
+			err := checkDeferredValues(a.Action)
+			if err != nil {
+				return err
+			}
+			return a.Verify(&context)
+		})
+	}
+
+	if options.Resume {
+		r.Actions = addResumeCheckpoints(r.Actions)
+	}
+
+	r.Actions, err = resolveCheckpoints(&context, r.Actions)
+	if err != nil {
+		fatalf("Invalid recipe: %v", err)
 	}
 
 	if !fakemachine.InMachine() && fakemachine.Supported() {
@@ -289,55 +934,204 @@ func main() {
 		m.AddVolume(context.artifactdir)
 		args = append(args, "--artifactdir", context.artifactdir)
 
+		if options.ScratchDir != "" {
+			scratch := CleanPath(options.ScratchDir)
+			m.AddVolume(scratch)
+			args = append(args, "--scratchdir", scratch)
+		}
+
+		if options.ScratchTmpfs != "" {
+			args = append(args, "--scratch-tmpfs-size", options.ScratchTmpfs)
+		}
+
 		for k, v := range options.TemplateVars {
 			args = append(args, "--template-var", fmt.Sprintf("%s:\"%s\"", k, v))
 		}
 
+		if options.TemplateExec {
+			args = append(args, "--template-exec")
+		}
+
+		if options.KillBusy {
+			args = append(args, "--kill-busy")
+		}
+
+		if options.Strict {
+			args = append(args, "--strict")
+		}
+
+		if options.DebugShell {
+			args = append(args, "--debug-shell")
+		}
+
+		if options.AllowWipe {
+			args = append(args, "--allow-wipe")
+		}
+
+		if options.AllowUnknown {
+			args = append(args, "--allow-unknown-keys")
+		}
+
+		if options.Resume {
+			args = append(args, "--resume")
+		}
+
+		if options.AptProxy != "" {
+			args = append(args, "--apt-proxy", options.AptProxy)
+		}
+
+		if options.Quiet {
+			args = append(args, "--quiet")
+		}
+
+		if options.Verbose {
+			args = append(args, "--verbose")
+		}
+
+		args = append(args, "--quiet-lines", strconv.Itoa(options.QuietLines))
+
+		args = append(args, "--umask", options.Umask)
+
+		if options.KeepOnFailure {
+			/* Whatever is kept goes away with the machine otherwise */
+			if options.ScratchDir == "" {
+				log.Printf("Warning: --keep-on-failure without --scratchdir only keeps the artifacts")
+			}
+			args = append(args, "--keep-on-failure")
+		}
+
 		m.AddVolume(context.recipeDir)
+		args = append(args, "--recipe-dir", context.recipeDir)
+
+		for _, v := range volumes {
+			m.AddVolume(v.host)
+			args = append(args, "--volume", v.String())
+		}
+
+		for _, d := range pluginDirs[1:] {
+			m.AddVolume(d)
+			args = append(args, "--plugin-dir", d)
+		}
+
+		recipeCopyDir, err := ioutil.TempDir("", "debos-recipe-")
+		if err != nil {
+			fatalf("Couldn't create recipe directory: %v", err)
+		}
+		m.AddVolume(recipeCopyDir)
+
+		expanded := path.Join(recipeCopyDir, "expanded.yaml")
+		err = ioutil.WriteFile(expanded, data.Bytes(), 0644)
+		if err != nil {
+			os.RemoveAll(recipeCopyDir)
+			fatalf("Couldn't write expanded recipe: %v", err)
+		}
+		args = append(args, "--internal-expanded-recipe", expanded)
+
+		/* The machine can't get at stdin and shouldn't refetch, so hand it
+		 * a copy of the recipe */
+		if file == "-" || isRemoteRecipe(file) {
+			file = path.Join(recipeCopyDir, "recipe.yaml")
+			err = ioutil.WriteFile(file, recipe, 0644)
+			if err != nil {
+				os.RemoveAll(recipeCopyDir)
+				fatalf("Couldn't write recipe copy: %v", err)
+			}
+		}
 		args = append(args, file)
 
+		if report != nil {
+			m.AddVolume(path.Dir(report.file))
+			args = append(args, "--report", report.file)
+		}
+
 		for _, a := range r.Actions {
-			err = a.PreMachine(&context, m, &args)
-			bailOnError(err, a, "PreMachine")
+			runStage(a, "PreMachine", func() error { return a.PreMachine(&context, m, &args) })
+		}
+
+		var secretsDir string
+		if len(context.secrets) > 0 {
+			secretsDir, err = ioutil.TempDir("", "debos-secrets-")
+			if err != nil {
+				fatalf("Couldn't create secrets directory: %v", err)
+			}
+
+			secrets := path.Join(secretsDir, "secrets.json")
+			err = writeSecrets(secrets, context.secrets)
+			if err != nil {
+				os.RemoveAll(secretsDir)
+				fatalf("Couldn't write secrets: %v", err)
+			}
+			m.AddVolume(secretsDir)
+			args = append(args, "--internal-secrets", secrets)
 		}
 
 		ret := m.RunInMachineWithArgs(args)
 
+		os.RemoveAll(recipeCopyDir)
+		if secretsDir != "" {
+			os.RemoveAll(secretsDir)
+		}
+
+		report.merge()
 		if ret != 0 {
+			report.finish("failed")
 			os.Exit(ret)
 		}
 
 		for _, a := range r.Actions {
-			err = a.PostMachine(context)
-			bailOnError(err, a, "Postmachine")
+			runStage(a, "Postmachine", func() error { return a.PostMachine(context) })
 		}
 
+		report.finish("success")
 		log.Printf("==== Recipe done ====")
 		os.Exit(0)
 	}
 
 	if !fakemachine.InMachine() {
 		for _, a := range r.Actions {
-			err = a.PreNoMachine(&context)
-			bailOnError(err, a, "PreNoMachine")
+			runStage(a, "PreNoMachine", func() error { return a.PreNoMachine(&context) })
 		}
 	}
 
-	for _, a := range r.Actions {
-		err = a.Run(&context)
+	for idx, a := range r.Actions {
+		err = doStage(a, "Run", func() error { return a.Run(&context) })
+		if err == nil {
+			continue
+		}
+
+		if options.DebugShell {
+			log.Printf("Action `%s` failed at stage Run, error: %s", a, err)
+			debugShell(&context)
+		}
+		if options.KeepOnFailure {
+			log.Printf("Action `%s` failed, keeping the build environment", a)
+			logBuildState(&context)
+			exitHandlers = nil
+			bailOnError(err, a, "Run")
+		}
+
+		/* Release what the actions so far set up, e.g. mounts and loop
+		 * devices */
+		for _, c := range r.Actions[:idx+1] {
+			cerr := doStage(c, "Cleanup", func() error { return c.Cleanup(context) })
+			if cerr != nil {
+				log.Printf("Cleanup of `%s` failed: %v", c, cerr)
+			}
+		}
 		bailOnError(err, a, "Run")
 	}
 
 	for _, a := range r.Actions {
-		err = a.Cleanup(context)
-		bailOnError(err, a, "Cleanup")
+		runStage(a, "Cleanup", func() error { return a.Cleanup(context) })
 	}
 
 	if !fakemachine.InMachine() {
 		for _, a := range r.Actions {
-			err = a.PostMachine(context)
-			bailOnError(err, a, "PostMachine")
+			runStage(a, "PostMachine", func() error { return a.PostMachine(context) })
 		}
 		log.Printf("==== Recipe done ====")
 	}
+
+	report.finish("success")
+	runExitHandlers()
 }
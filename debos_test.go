@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+var misspeltRecipe = `
+architecture: amd64
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: root
+        fs: ext4
+        start: 1MiB
+        end: 100%
+    mountpoints:
+      - mountpoint: /
+        parition: root
+`
+
+func TestStrictRecipe(t *testing.T) {
+	_, err := parseRecipe([]byte(misspeltRecipe), true)
+	if err == nil {
+		t.Fatalf("Misspelt key accepted")
+	}
+	if !strings.Contains(err.Error(), "line 15: field parition not found") {
+		t.Errorf("Unclear error for a misspelt key: %v", err)
+	}
+
+	r, err := parseRecipe([]byte(misspeltRecipe), false)
+	if err != nil {
+		t.Fatalf("Misspelt key not ignored: %v", err)
+	}
+	if len(r.Actions) != 1 {
+		t.Errorf("Got %d actions instead of 1", len(r.Actions))
+	}
+}
+
+var unknownActionsRecipe = `
+architecture: amd64
+actions:
+  - action: frobnicate
+  - action: run
+    command: "true"
+  - action: defrobnicate
+`
+
+func TestUnknownActions(t *testing.T) {
+	_, err := parseRecipe([]byte(unknownActionsRecipe), true)
+	if _, ok := err.(*yaml.TypeError); !ok {
+		t.Fatalf("Unknown actions not reported as type errors: %v", err)
+	}
+
+	issues := lintRecipe(&DebosContext{}, "unknown", []byte(unknownActionsRecipe))
+	if len(issues) != 2 {
+		t.Errorf("Got %d issues instead of 2: %v", len(issues), issues)
+	}
+}
+
+func TestRootfsPath(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "debos-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	os.MkdirAll(path.Join(rootdir, "run/systemd"), 0755)
+	os.MkdirAll(path.Join(rootdir, "etc"), 0755)
+	os.Symlink("/run/systemd/resolv.conf", path.Join(rootdir, "etc/resolv.conf"))
+	os.Symlink("../../../../etc", path.Join(rootdir, "run/systemd/etc"))
+
+	for file, expected := range map[string]string{
+		"/etc/hostname":           "/etc/hostname",
+		"/etc/resolv.conf":        "/run/systemd/resolv.conf",
+		"/run/systemd/etc/passwd": "/etc/passwd",
+		"new/dir/file":            "/new/dir/file",
+	} {
+		resolved, err := rootfsPath(rootdir, file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if resolved != path.Join(rootdir, expected) {
+			t.Errorf("%s resolved to %s instead of %s", file, resolved, expected)
+		}
+	}
+}
+
+func TestDeferredValues(t *testing.T) {
+	command := templateDeferredValue("image.file")
+
+	if err := checkDeferredValues(&RunAction{Command: command}); err == nil {
+		t.Errorf("value accepted in a command that isn't expanded again")
+	}
+	if err := checkDeferredValues(&RunAction{Command: command, Values: true}); err != nil {
+		t.Errorf("value refused in a command expanded again: %v", err)
+	}
+	if err := checkDeferredValues(&RunAction{Command: command, Script: command, Values: true}); err == nil {
+		t.Errorf("value accepted in a script")
+	}
+}
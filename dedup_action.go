@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/go-units"
+)
+
+/* Replaces files in the rootfs with identical content by hardlinks to one of
+ * them, or with reflinks sharing the data on btrfs and xfs. Hardlinked files
+ * share their permissions too, so only files with the same ones are linked,
+ * and later changes to one change all of them; dedup wants to be the last
+ * action changing the rootfs. Files with extended attributes are left alone,
+ * as are the keep paths, by default /etc and /var whose files get modified in
+ * place on the running system */
+type DedupAction struct {
+	BaseAction `yaml:",inline"`
+	Method     string   // hardlink or reflink
+	Keep       []string // Globs (relative to the rootfs) of files and directories left alone
+	MinSize    string   // Smaller files aren't worth it
+	minSize    int64
+}
+
+/* Files can only be deduplicated within a filesystem, and hardlinked ones
+ * have to agree on their metadata */
+type dedupKey struct {
+	dev  uint64
+	size int64
+	mode os.FileMode
+	uid  uint32
+	gid  uint32
+}
+
+type dedupInode struct {
+	dev uint64
+	ino uint64
+}
+
+func newDedupAction() *DedupAction {
+	return &DedupAction{Method: "hardlink", Keep: []string{"etc", "var"}, MinSize: "1KB"}
+}
+
+func (d *DedupAction) Verify(context *DebosContext) error {
+	if d.Method != "hardlink" && d.Method != "reflink" {
+		return fmt.Errorf("Unknown dedup method %s", d.Method)
+	}
+
+	err := checkKeepPatterns(d.Keep)
+	if err != nil {
+		return err
+	}
+
+	size, err := units.FromHumanSize(d.MinSize)
+	if err != nil {
+		return fmt.Errorf("Failed to parse minimum size %s", d.MinSize)
+	}
+	if size < 1 {
+		return errors.New("Minimum size has to be at least a byte")
+	}
+	d.minSize = size
+
+	return nil
+}
+
+/* Whether the path or a directory it's in matches one of the keep globs */
+func keepPath(keep []string, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = filepath.Dir(p) {
+		for _, k := range keep {
+			if m, _ := filepath.Match(k, p); m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkKeepPatterns(keep []string) error {
+	for _, k := range keep {
+		if _, err := filepath.Match(k, ""); err != nil {
+			return fmt.Errorf("Invalid keep pattern %s", k)
+		}
+	}
+	return nil
+}
+
+/* Replace dup by the content of orig, keeping the metadata of dup in the
+ * reflink case */
+func (d *DedupAction) replace(orig, dup string, info os.FileInfo) error {
+	tmp := dup + ".debos-dedup"
+	if d.Method == "hardlink" {
+		err := os.Link(orig, tmp)
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmp, dup)
+	}
+
+	out, err := exec.Command("cp", "--reflink=always", orig, tmp).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("reflink failed, the filesystem may not support it: %s", out)
+	}
+
+	st := info.Sys().(*syscall.Stat_t)
+	err = os.Lchown(tmp, int(st.Uid), int(st.Gid))
+	if err == nil {
+		err = os.Chmod(tmp, info.Mode())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dup)
+}
+
+func (d *DedupAction) Run(context *DebosContext) error {
+	d.LogStart()
+
+	candidates := make(map[dedupKey][]string)
+	infos := make(map[string]os.FileInfo)
+	seen := make(map[dedupInode]bool)
+
+	err := filepath.Walk(context.rootdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(context.rootdir, p)
+		if rel != "." && keepPath(d.Keep, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() < d.minSize {
+			return nil
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		/* Already hardlinked files are only looked at once */
+		inode := dedupInode{uint64(st.Dev), st.Ino}
+		if seen[inode] {
+			return nil
+		}
+		seen[inode] = true
+
+		if size, _ := syscall.Listxattr(p, nil); size > 0 {
+			return nil
+		}
+
+		key := dedupKey{dev: uint64(st.Dev), size: info.Size()}
+		if d.Method == "hardlink" {
+			key.mode, key.uid, key.gid = info.Mode(), st.Uid, st.Gid
+		}
+		candidates[key] = append(candidates[key], p)
+		infos[p] = info
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var saved int64
+	var count int
+	for key, files := range candidates {
+		if len(files) < 2 {
+			continue
+		}
+
+		originals := make(map[string]string)
+		for _, f := range files {
+			sum, err := fileSha256(f)
+			if err != nil {
+				return err
+			}
+
+			orig, ok := originals[sum]
+			if !ok {
+				originals[sum] = f
+				continue
+			}
+
+			err = d.replace(orig, f, infos[f])
+			if err != nil {
+				rel, _ := filepath.Rel(context.rootdir, f)
+				return fmt.Errorf("Couldn't deduplicate %s: %v", rel, err)
+			}
+			saved += key.size
+			count++
+		}
+	}
+
+	log.Printf("Deduplicated %d files, saving %s\n", count, units.BytesSize(float64(saved)))
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+)
+
+/* Reports the usage of the filesystems mounted in the rootfs, e.g. the
+ * image partitions after filesystem-deploy, and fails the build when the
+ * thresholds are exceeded to catch images getting bloated. The numbers also
+ * go to the build report so they can be tracked */
+type DiskUsageAction struct {
+	BaseAction  `yaml:",inline"`
+	Mountpoints []string // Paths in the rootfs, / by default
+	MaxUsage    int      // Percent
+	MinFree     string
+	minFree     int64
+}
+
+func newDiskUsageAction() *DiskUsageAction {
+	return &DiskUsageAction{Mountpoints: []string{"/"}}
+}
+
+func (du *DiskUsageAction) Verify(context *DebosContext) error {
+	if len(du.Mountpoints) == 0 {
+		return errors.New("No mountpoints to check")
+	}
+	for _, m := range du.Mountpoints {
+		if !path.IsAbs(m) {
+			return fmt.Errorf("Mountpoint %s isn't an absolute path", m)
+		}
+	}
+
+	if du.MaxUsage < 0 || du.MaxUsage > 100 {
+		return fmt.Errorf("Invalid maximum usage %d%%", du.MaxUsage)
+	}
+
+	if du.MinFree != "" {
+		size, err := units.RAMInBytes(du.MinFree)
+		if err != nil {
+			return fmt.Errorf("Failed to parse minimum free space %s", du.MinFree)
+		}
+		du.minFree = size
+	}
+
+	return nil
+}
+
+func (du *DiskUsageAction) Run(context *DebosContext) error {
+	du.LogStart()
+	var problems []string
+
+	for _, m := range du.Mountpoints {
+		var st syscall.Statfs_t
+		err := syscall.Statfs(path.Join(context.rootdir, m), &st)
+		if err != nil {
+			return fmt.Errorf("Couldn't get usage of %s: %v", m, err)
+		}
+
+		/* Like df, usage is relative to what unprivileged users can use */
+		used := int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+		free := int64(st.Bavail) * int64(st.Bsize)
+		usage := 0
+		if used+free > 0 {
+			usage = int((used*100 + used + free - 1) / (used + free))
+		}
+
+		log.Printf("%s: %s used, %s free (%d%%)\n", m, units.BytesSize(float64(used)),
+			units.BytesSize(float64(free)), usage)
+		report.addDiskUsage(diskUsageReport{m, used, free, usage})
+
+		if du.MaxUsage > 0 && usage > du.MaxUsage {
+			problems = append(problems, fmt.Sprintf("%s is %d%% full", m, usage))
+		}
+		if du.minFree > 0 && free < du.minFree {
+			problems = append(problems, fmt.Sprintf("%s has only %s free", m,
+				units.BytesSize(float64(free))))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Disk usage over the limits: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
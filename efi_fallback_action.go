@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/* Installs an EFI bootloader, as put in place by e.g. grub-install or
+ * bootctl, at the removable media path \EFI\BOOT\BOOT<arch>.EFI as well.
+ * Firmware looks there when it has no boot entry for the disk, which is
+ * always the case for a freshly written USB stick */
+type EfiFallbackAction struct {
+	BaseAction `yaml:",inline"`
+	Bootloader string // Path in the rootfs, e.g. /boot/efi/EFI/debian/shimx64.efi
+	Esp        string // Mountpoint of the EFI system partition in the rootfs
+}
+
+var efiFallbackNames = map[string]string{
+	"amd64":   "BOOTX64.EFI",
+	"i386":    "BOOTIA32.EFI",
+	"arm64":   "BOOTAA64.EFI",
+	"armhf":   "BOOTARM.EFI",
+	"armel":   "BOOTARM.EFI",
+	"riscv64": "BOOTRISCV64.EFI",
+}
+
+func newEfiFallbackAction() *EfiFallbackAction {
+	return &EfiFallbackAction{Esp: "/boot/efi"}
+}
+
+func (ef *EfiFallbackAction) Verify(context *DebosContext) error {
+	if ef.Bootloader == "" {
+		return errors.New("No bootloader given")
+	}
+
+	if _, ok := efiFallbackNames[context.Architecture]; !ok {
+		return fmt.Errorf("No EFI fallback bootloader name for %s", context.Architecture)
+	}
+
+	if !strings.HasPrefix(path.Clean(ef.Bootloader), path.Clean(ef.Esp)+"/") {
+		return fmt.Errorf("Bootloader %s isn't on the ESP at %s", ef.Bootloader, ef.Esp)
+	}
+
+	return nil
+}
+
+func (ef *EfiFallbackAction) Run(context *DebosContext) error {
+	ef.LogStart()
+
+	src := path.Join(context.rootdir, ef.Bootloader)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("Couldn't find bootloader: %v", err)
+	}
+
+	dir := path.Join(context.rootdir, ef.Esp, "EFI/BOOT")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	dst := path.Join(dir, efiFallbackNames[context.Architecture])
+	log.Printf("Installing %s as %s\n", ef.Bootloader, dst)
+	err = CopyFile(src, dst, 0644)
+	if err != nil {
+		return err
+	}
+
+	/* shim loads the actual bootloader (and MokManager) from its own
+	 * directory, so those have to come along */
+	if !strings.HasPrefix(path.Base(ef.Bootloader), "shim") {
+		return nil
+	}
+	others, err := filepath.Glob(path.Join(path.Dir(src), "*.efi"))
+	if err != nil {
+		return err
+	}
+	for _, o := range others {
+		if o == src || strings.HasPrefix(path.Base(o), "shim") {
+			continue
+		}
+		err = CopyFile(o, path.Join(dir, path.Base(o)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
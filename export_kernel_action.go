@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+/* Copies the kernel and initrd of the rootfs to the artifact directory as
+ * standalone files, e.g. for netbooting, named PREFIXvmlinuz and
+ * PREFIXinitrd.img whatever the kernel version is */
+type ExportKernelAction struct {
+	BaseAction `yaml:",inline"`
+	Kernel     string // Kernel version, defaults to the newest installed
+	Prefix     string
+	NoInitrd   bool // Only export the kernel
+}
+
+/* Names the kernel and initrd go by in /boot across distributions */
+var kernelNames = []string{"boot/vmlinuz-%s", "boot/vmlinux-%s", "boot/Image-%s"}
+var initrdNames = []string{"boot/initrd.img-%s", "boot/initramfs-%s.img", "boot/initrd-%s"}
+
+func findBootFile(rootdir string, names []string, version string) (string, error) {
+	for _, n := range names {
+		f := path.Join(rootdir, fmt.Sprintf(n, version))
+		if _, err := os.Stat(f); err == nil {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("Nothing like /%s in the rootfs", fmt.Sprintf(names[0], version))
+}
+
+func (ek *ExportKernelAction) Run(context *DebosContext) error {
+	ek.LogStart()
+
+	version := ek.Kernel
+	if version == "" {
+		var err error
+		version, err = newestKernelVersion(context.rootdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := []string{"vmlinuz", "initrd.img"}
+	candidates := [][]string{kernelNames, initrdNames}
+	if ek.NoInitrd {
+		names = names[:1]
+	}
+
+	for idx, name := range names {
+		src, err := findBootFile(context.rootdir, candidates[idx], version)
+		if err != nil {
+			return err
+		}
+
+		dst := path.Join(context.artifactdir, ek.Prefix+name)
+		err = CopyFile(src, dst, 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't export %s: %v", name, err)
+		}
+		log.Printf("Exported %s as %s\n", src[len(context.rootdir):], dst)
+	}
+
+	log.Printf("Exported kernel version %s\n", version)
+	context.SetValue("kernel.version", version)
+
+	return nil
+}
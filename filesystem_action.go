@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+/* Builds a filesystem image in the artifact directory straight from a
+ * directory of the rootfs, with the mkfs tools populating it themselves
+ * rather than by mounting it. A later image-partition writes it to a
+ * partition by naming the same file as the partition source, so the
+ * filesystem is put together independently of the image layout */
+type FilesystemAction struct {
+	BaseAction  `yaml:",inline"`
+	File        string // In the artifact directory
+	Source      string // Directory in the rootfs
+	FS          string
+	Size        string // Not needed for squashfs and erofs, which fit the content
+	Label       string
+	MkfsOptions []string
+	size        int64
+}
+
+func newFilesystemAction() *FilesystemAction {
+	return &FilesystemAction{Source: "/"}
+}
+
+func (fs *FilesystemAction) Verify(context *DebosContext) error {
+	if fs.File == "" {
+		return errors.New("No filesystem file given")
+	}
+
+	switch fs.FS {
+	case "ext2", "ext3", "ext4", "btrfs", "fat32":
+		size, err := units.FromHumanSize(fs.Size)
+		if err != nil {
+			return fmt.Errorf("Failed to parse size %s of %s", fs.Size, fs.File)
+		}
+		if min, ok := filesystemMinSize[fs.FS]; ok && size < min {
+			return fmt.Errorf("%s is too small for %s", fs.File, fs.FS)
+		}
+		fs.size = size
+	case "squashfs", "erofs":
+		if fs.Size != "" {
+			return fmt.Errorf("%s images are as large as their content, no size needed", fs.FS)
+		}
+	case "":
+		return fmt.Errorf("No fs type for %s", fs.File)
+	default:
+		return fmt.Errorf("Can't build %s filesystems from a directory", fs.FS)
+	}
+
+	/* For image-partition to find it as a source before it exists */
+	context.SetValue("filesystem."+fs.File, path.Join(context.artifactdir, fs.File))
+
+	return nil
+}
+
+/* mcopy has no option to copy the content of a directory, only entries */
+func (fs *FilesystemAction) fatCopy(file, source string) error {
+	entries, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	cmdline := []string{"mcopy", "-s", "-p", "-i", file}
+	for _, e := range entries {
+		cmdline = append(cmdline, path.Join(source, e.Name()))
+	}
+	cmdline = append(cmdline, "::/")
+
+	return Command{}.Run("filesystem", cmdline...)
+}
+
+func (fs *FilesystemAction) Run(context *DebosContext) error {
+	fs.LogStart()
+	file := path.Join(context.artifactdir, fs.File)
+	source, err := context.subRootdir(strings.TrimPrefix(path.Clean("/"+fs.Source), "/"))
+	if err != nil {
+		return err
+	}
+
+	os.Remove(file)
+	if fs.size != 0 {
+		err = createImageFile(file, fs.size)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cmdline []string
+	switch fs.FS {
+	case "ext2", "ext3", "ext4":
+		cmdline = []string{"mkfs." + fs.FS, "-F", "-d", source}
+		if fs.Label != "" {
+			cmdline = append(cmdline, "-L", fs.Label)
+		}
+		cmdline = append(cmdline, fs.MkfsOptions...)
+		cmdline = append(cmdline, file)
+	case "btrfs":
+		cmdline = []string{"mkfs.btrfs", "--rootdir", source}
+		if fs.Label != "" {
+			cmdline = append(cmdline, "-L", fs.Label)
+		}
+		cmdline = append(cmdline, fs.MkfsOptions...)
+		cmdline = append(cmdline, file)
+	case "fat32":
+		cmdline = []string{"mkfs.vfat"}
+		if fs.Label != "" {
+			cmdline = append(cmdline, "-n", fs.Label)
+		}
+		cmdline = append(cmdline, fs.MkfsOptions...)
+		cmdline = append(cmdline, file)
+	case "squashfs":
+		cmdline = []string{"mksquashfs", source, file, "-noappend"}
+		cmdline = append(cmdline, fs.MkfsOptions...)
+	case "erofs":
+		cmdline = []string{"mkfs.erofs"}
+		if fs.Label != "" {
+			cmdline = append(cmdline, "-L", fs.Label)
+		}
+		cmdline = append(cmdline, fs.MkfsOptions...)
+		cmdline = append(cmdline, file, source)
+	}
+
+	err = Command{}.Run("filesystem", cmdline...)
+	if err != nil {
+		return err
+	}
+
+	if fs.FS == "fat32" {
+		return fs.fatCopy(file, source)
+	}
+
+	return nil
+}
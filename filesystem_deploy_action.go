@@ -13,8 +13,9 @@ import (
 
 type FilesystemDeployAction struct {
 	BaseAction         `yaml:",inline"`
-	SetupFSTab         bool `yaml:setup-fstab`
-	SetupKernelCmdline bool `yaml:setup-kernel-cmdline`
+	SetupFSTab         bool   `yaml:setup-fstab`
+	SetupKernelCmdline bool   `yaml:setup-kernel-cmdline`
+	Rootdir            string // Subdirectory of the rootfs to deploy
 }
 
 func newFilesystemDeployAction() *FilesystemDeployAction {
@@ -24,6 +25,10 @@ func newFilesystemDeployAction() *FilesystemDeployAction {
 	return fd
 }
 
+func (fd *FilesystemDeployAction) Verify(context *DebosContext) error {
+	return checkSubRootdir(fd.Rootdir)
+}
+
 func (fd *FilesystemDeployAction) setupFSTab(context *DebosContext) error {
 	if context.imageFSTab.Len() == 0 {
 		return errors.New("Fstab not generated, missing image-partition action?")
@@ -86,7 +91,11 @@ func (fd *FilesystemDeployAction) Run(context *DebosContext) error {
 	/* Copying files is actually silly hafd, one has to keep permissions, ACL's
 	 * extended attribute, misc, other. Leave it to cp...
 	 */
-	err := Command{}.Run("Deploy to image", "cp", "-a", context.rootdir+"/.", context.imageMntDir)
+	rootdir, err := context.subRootdir(fd.Rootdir)
+	if err != nil {
+		return err
+	}
+	err = Command{}.Run("Deploy to image", "cp", "-a", rootdir+"/.", context.imageMntDir)
 	if err != nil {
 		return fmt.Errorf("rootfs deploy failed: %v", err)
 	}
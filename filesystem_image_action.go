@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/docker/go-units"
+)
+
+/* Builds a filesystem image as a file inside the rootfs, for e.g. an
+ * embedded ESP or firmware bundle living on another partition. It can be
+ * populated from a directory in the recipe and stay mounted at a
+ * mountpoint in the rootfs while staging, so later actions can fill it. A
+ * mounted image is only complete after cleanup, so it should already be in
+ * its final place by then, e.g. with filesystem-deploy done beforehand */
+type FilesystemImageAction struct {
+	BaseAction `yaml:",inline"`
+	File       string // Path in the rootfs
+	Size       string
+	FS         string
+	Label      string
+	Source     string // Directory to copy in, relative to the recipe
+	Mountpoint string // Path in the rootfs to keep it mounted at
+	size       int64
+	mntpath    string
+}
+
+func (fi *FilesystemImageAction) Verify(context *DebosContext) error {
+	if fi.File == "" {
+		return errors.New("No filesystem image file given")
+	}
+
+	if fi.FS == "" {
+		return fmt.Errorf("No fs type for %s", fi.File)
+	}
+
+	size, err := units.FromHumanSize(fi.Size)
+	if err != nil {
+		return fmt.Errorf("Failed to parse size %s of %s", fi.Size, fi.File)
+	}
+	fi.size = size
+
+	if min, ok := filesystemMinSize[fi.FS]; ok && size < min {
+		return fmt.Errorf("%s is too small for %s", fi.File, fi.FS)
+	}
+
+	return nil
+}
+
+func (fi *FilesystemImageAction) mkfs(file string) error {
+	var cmdline []string
+	switch fi.FS {
+	case "fat32":
+		cmdline = []string{"mkfs.vfat"}
+		if fi.Label != "" {
+			cmdline = append(cmdline, "-n", fi.Label)
+		}
+	default:
+		cmdline = []string{fmt.Sprintf("mkfs.%s", fi.FS)}
+		if fi.Label != "" {
+			cmdline = append(cmdline, "-L", fi.Label)
+		}
+		if isExtFS(fi.FS) {
+			cmdline = append(cmdline, "-F")
+		}
+	}
+	cmdline = append(cmdline, file)
+
+	return Command{}.Run("filesystem-image", cmdline...)
+}
+
+func (fi *FilesystemImageAction) Run(context *DebosContext) error {
+	fi.LogStart()
+	file := path.Join(context.rootdir, fi.File)
+
+	err := os.MkdirAll(path.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+
+	img, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't create %s: %v", fi.File, err)
+	}
+	err = img.Truncate(fi.size)
+	img.Close()
+	if err != nil {
+		return fmt.Errorf("Couldn't resize %s: %v", fi.File, err)
+	}
+
+	err = fi.mkfs(file)
+	if err != nil {
+		return err
+	}
+
+	if fi.Source == "" && fi.Mountpoint == "" {
+		return nil
+	}
+
+	mntpath := path.Join(context.rootdir, fi.Mountpoint)
+	if fi.Mountpoint == "" {
+		mntpath, err = ioutil.TempDir(context.scratchdir, "fsimage-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(mntpath)
+	}
+
+	err = os.MkdirAll(mntpath, 0755)
+	if err != nil {
+		return err
+	}
+	err = Command{}.Run("filesystem-image", "mount", "-o", "loop", file, mntpath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Source != "" {
+		err = CopyTree(CleanPathAt(fi.Source, context.recipeDir), mntpath)
+		if err != nil {
+			unmount(mntpath, context.killBusy)
+			return err
+		}
+	}
+
+	if fi.Mountpoint == "" {
+		return unmount(mntpath, context.killBusy)
+	}
+
+	/* Stays mounted until cleanup */
+	fi.mntpath = mntpath
+	return nil
+}
+
+func (fi *FilesystemImageAction) Cleanup(context DebosContext) error {
+	if fi.mntpath == "" {
+		return nil
+	}
+	return unmount(fi.mntpath, context.killBusy)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/debos/fakemachine"
+)
+
+/* Bootstraps from an existing rootfs tarball instead of building one, e.g. a
+ * tarball produced earlier by the pack action. Works offline */
+type FromTarballAction struct {
+	BaseAction  `yaml:",inline"`
+	File        string // Relative to the recipe
+	Compression string // gz, xz or zstd, guessed from the file name by default
+	Sha256      string
+}
+
+var tarCompressionOptions = map[string]string{
+	"none": "",
+	"gz":   "--gzip",
+	"xz":   "--xz",
+	"zstd": "--zstd",
+}
+
+func tarCompression(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".gz"), strings.HasSuffix(file, ".tgz"):
+		return "gz"
+	case strings.HasSuffix(file, ".xz"):
+		return "xz"
+	case strings.HasSuffix(file, ".zst"):
+		return "zstd"
+	}
+	return "none"
+}
+
+func (ft *FromTarballAction) Verify(context *DebosContext) error {
+	if ft.File == "" {
+		return errors.New("No tarball to bootstrap from")
+	}
+
+	_, err := os.Stat(CleanPathAt(ft.File, context.recipeDir))
+	if err != nil {
+		return fmt.Errorf("Couldn't find tarball: %v", err)
+	}
+
+	if ft.Compression == "" {
+		ft.Compression = tarCompression(ft.File)
+	}
+	if _, ok := tarCompressionOptions[ft.Compression]; !ok {
+		return fmt.Errorf("Unknown compression %s", ft.Compression)
+	}
+
+	return nil
+}
+
+func (ft *FromTarballAction) PreMachine(context *DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	m.AddVolume(path.Dir(CleanPathAt(ft.File, context.recipeDir)))
+	return nil
+}
+
+func (ft *FromTarballAction) Run(context *DebosContext) error {
+	return runBootstrap(ft, context)
+}
+
+func (ft *FromTarballAction) Bootstrap(context *DebosContext) error {
+	file := CleanPathAt(ft.File, context.recipeDir)
+
+	if ft.Sha256 != "" {
+		sum, err := fileSha256(file)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, ft.Sha256) {
+			return fmt.Errorf("Checksum mismatch for %s: got %s, expected %s", ft.File, sum, ft.Sha256)
+		}
+	}
+
+	/* Keep ownership, permissions and xattrs (e.g. file capabilities) as
+	 * they were in the tarball */
+	cmdline := []string{"tar", "--numeric-owner", "--same-permissions",
+		"--xattrs", "--xattrs-include=*", "-x", "-f", file, "-C", context.rootdir}
+	if opt := tarCompressionOptions[ft.Compression]; opt != "" {
+		cmdline = append(cmdline, opt)
+	}
+
+	return Command{}.Run("from-tarball", cmdline...)
+}
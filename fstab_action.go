@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+type FstabEntry struct {
+	Device     string
+	Mountpoint string
+	Type       string
+	Options    []string
+	Dump       int
+	Pass       int
+}
+
+/* Appends entries to the targets fstab for mounts not backed by the image
+ * partitions, e.g. network shares. Entries for the image partitions
+ * themselves come from image-partition through filesystem-deploy, which
+ * writes the fstab from scratch, so this has to run after it */
+type FstabAction struct {
+	BaseAction `yaml:",inline"`
+	Entries    []FstabEntry
+}
+
+/* fstab fields are whitespace separated, so spaces and tabs are written as
+ * octal escapes */
+func fstabEscape(field string) string {
+	r := strings.NewReplacer(" ", `\040`, "\t", `\011`, "\n", `\012`, `\`, `\134`)
+	return r.Replace(field)
+}
+
+/* Change the fields of the fstab entry for a mountpoint in the rootfs */
+func editFstabEntry(rootdir, mountpoint string, edit func(fields []string)) error {
+	file := path.Join(rootdir, "etc/fstab")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't read fstab: %v", err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	for idx, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) < 4 || fields[1] != mountpoint {
+			continue
+		}
+		edit(fields)
+		lines[idx] = strings.Join(fields, "\t")
+	}
+
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+func (fa *FstabAction) Verify(context *DebosContext) error {
+	if len(fa.Entries) == 0 {
+		return errors.New("No fstab entries given")
+	}
+
+	for _, e := range fa.Entries {
+		if e.Device == "" || e.Mountpoint == "" || e.Type == "" {
+			return fmt.Errorf("fstab entry %s needs a device, mountpoint and type", e.Mountpoint)
+		}
+		if e.Mountpoint != "none" && e.Mountpoint != "swap" && !path.IsAbs(e.Mountpoint) {
+			return fmt.Errorf("fstab mountpoint %s isn't an absolute path", e.Mountpoint)
+		}
+		if e.Pass < 0 || e.Pass > 2 {
+			return fmt.Errorf("fstab entry %s: invalid pass %d", e.Mountpoint, e.Pass)
+		}
+	}
+
+	return nil
+}
+
+func (fa *FstabAction) Run(context *DebosContext) error {
+	fa.LogStart()
+
+	err := os.MkdirAll(path.Join(context.rootdir, "etc"), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path.Join(context.rootdir, "etc/fstab"),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't open fstab: %v", err)
+	}
+	defer f.Close()
+
+	for _, e := range fa.Entries {
+		options := "defaults"
+		if len(e.Options) > 0 {
+			options = strings.Join(e.Options, ",")
+		}
+
+		_, err = fmt.Fprintf(f, "%s\t%s\t%s\t%s\t%d\t%d\n", fstabEscape(e.Device),
+			fstabEscape(e.Mountpoint), e.Type, fstabEscape(options), e.Dump, e.Pass)
+		if err != nil {
+			return fmt.Errorf("Couldn't write fstab: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/* Installs a key distributed out of band as an apt keyring in the target,
+ * after checking it is the key the recipe expects. With host-keyring the
+ * keyring is also written to the artifact directory, where the keyrings of
+ * later debootstrap and apt actions can refer to it by that name */
+type GpgImportAction struct {
+	BaseAction  `yaml:",inline"`
+	Key         string // Key file, relative to the recipe
+	Url         string // Or where to download it from
+	Fingerprint string
+	Keyring     string // Keyring in the target, defaults to trusted.gpg.d
+	HostKeyring string // Keyring in the artifact directory, for the build itself
+}
+
+func normalizeFingerprint(fpr string) string {
+	return strings.ToUpper(strings.Replace(fpr, " ", "", -1))
+}
+
+func (gi *GpgImportAction) Verify(context *DebosContext) error {
+	if (gi.Key == "") == (gi.Url == "") {
+		return errors.New("Exactly one of key and url is needed")
+	}
+
+	gi.Fingerprint = normalizeFingerprint(gi.Fingerprint)
+	if len(gi.Fingerprint) != 40 {
+		return fmt.Errorf("Fingerprint %s isn't a full v4 fingerprint", gi.Fingerprint)
+	}
+
+	if gi.Keyring == "" {
+		gi.Keyring = fmt.Sprintf("/etc/apt/trusted.gpg.d/%s.gpg", gi.Fingerprint[24:])
+	}
+	if !path.IsAbs(gi.Keyring) || path.Ext(gi.Keyring) != ".gpg" {
+		return fmt.Errorf("Keyring %s should be an absolute path to a .gpg file", gi.Keyring)
+	}
+
+	if gi.HostKeyring != "" {
+		if path.IsAbs(gi.HostKeyring) || path.Base(gi.HostKeyring) != gi.HostKeyring ||
+			path.Ext(gi.HostKeyring) != ".gpg" {
+			return fmt.Errorf("Host keyring %s should be the name of a .gpg file", gi.HostKeyring)
+		}
+		context.SetValue("keyring."+gi.HostKeyring, path.Join(context.artifactdir, gi.HostKeyring))
+	}
+
+	if gi.Key != "" && !context.linting {
+		return checkKeyFingerprint(CleanPathAt(gi.Key, context.recipeDir), gi.Fingerprint)
+	}
+
+	return nil
+}
+
+/* The file has to hold exactly the one key with the expected fingerprint,
+ * anything more would get trusted as well */
+func checkKeyFingerprint(file, fingerprint string) error {
+	out, err := exec.Command("gpg", "--batch", "--show-keys", "--with-colons",
+		"--with-fingerprint", file).Output()
+	if err != nil {
+		return fmt.Errorf("Couldn't read key %s: %v", file, err)
+	}
+
+	/* The first fpr record after a pub record is the primary key's */
+	var primaries []string
+	pub := false
+	for _, l := range strings.Split(string(out), "\n") {
+		fields := strings.Split(l, ":")
+		switch {
+		case fields[0] == "pub":
+			pub = true
+		case fields[0] == "fpr" && pub && len(fields) > 9:
+			primaries = append(primaries, fields[9])
+			pub = false
+		}
+	}
+
+	if len(primaries) != 1 {
+		return fmt.Errorf("Expected a single key in %s, found %d", file, len(primaries))
+	}
+	if primaries[0] != fingerprint {
+		return fmt.Errorf("Key fingerprint %s doesn't match the expected %s", primaries[0], fingerprint)
+	}
+
+	return nil
+}
+
+func (gi *GpgImportAction) fetch(dir string) (string, error) {
+	resp, err := http.Get(gi.Url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Couldn't fetch %s: %s", gi.Url, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	file := path.Join(dir, "key")
+	return file, ioutil.WriteFile(file, content, 0644)
+}
+
+func (gi *GpgImportAction) Run(context *DebosContext) error {
+	gi.LogStart()
+
+	tmp, err := ioutil.TempDir(context.scratchdir, "gpg-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	key := CleanPathAt(gi.Key, context.recipeDir)
+	if gi.Url != "" {
+		key, err = gi.fetch(tmp)
+		if err != nil {
+			return err
+		}
+		err = checkKeyFingerprint(key, gi.Fingerprint)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = Command{}.Run("gpg-import", "gpg", "--batch", "--homedir", tmp,
+		"--import", key)
+	if err != nil {
+		return err
+	}
+
+	/* apt's keyrings are plain binary keys, whatever the key came as; an
+	 * import into a new keyring file would make it a keybox instead */
+	keyrings := []string{path.Join(context.rootdir, gi.Keyring)}
+	if gi.HostKeyring != "" {
+		keyrings = append(keyrings, path.Join(context.artifactdir, gi.HostKeyring))
+	}
+	for _, keyring := range keyrings {
+		err = os.MkdirAll(path.Dir(keyring), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = Command{}.Run("gpg-import", "gpg", "--batch", "--homedir", tmp,
+			"--yes", "--output", keyring, "--export", gi.Fingerprint)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Makes the image grow its root partition and filesystem to fill the disk
+ * it boots from the first time, so a minimal image can go onto disks of any
+ * size. The root partition has to be the last one. With the service method a
+ * first boot service grows it with growpart (from cloud-guest-utils) after
+ * moving the backup GPT as the image-partition expandgpt marker asks for;
+ * with repart systemd-repart grows the partition and systemd-growfs the
+ * filesystem. systemd-repart goes by the partition type, so for repart the
+ * root partition needs the discoverable root type of the architecture */
+type GrowRootAction struct {
+	BaseAction `yaml:",inline"`
+	Method     string // service or repart
+	rootType   string // Of the root partition, for the repart definition
+}
+
+const growRootMarker = "var/lib/debos/grow-root"
+
+const growRootScript = `#!/bin/sh
+set -e
+
+part=$(findmnt -n -o SOURCE /)
+disk=/dev/$(lsblk -n -o PKNAME "$part")
+number=$(cat /sys/class/block/$(basename "$part")/partition)
+
+if [ -e /` + expandGPTMarker + ` ]; then
+	sgdisk -e "$disk"
+	rm /` + expandGPTMarker + `
+fi
+
+# growpart fails with NOCHANGE when there is no room to grow into
+growpart "$disk" "$number" || true
+
+case $(findmnt -n -o FSTYPE /) in
+ext2|ext3|ext4) resize2fs "$part" ;;
+xfs) xfs_growfs / ;;
+btrfs) btrfs filesystem resize max / ;;
+esac
+
+rm /` + growRootMarker + `
+`
+
+const growRootService = `[Unit]
+Description=Grow the root filesystem to fill the disk
+ConditionPathExists=/` + growRootMarker + `
+DefaultDependencies=no
+After=local-fs.target
+Before=sysinit.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/sbin/debos-grow-root
+
+[Install]
+WantedBy=sysinit.target
+`
+
+/* Discoverable root partition types, with their sgdisk shorthands and
+ * systemd-repart names */
+var growRootTypes = map[string]struct{ guid, code, repart string }{
+	"amd64":   {"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709", "8304", "root-x86-64"},
+	"arm64":   {"B921B045-1DF0-41C3-AF44-4C6F280D3FAE", "8305", "root-arm64"},
+	"armhf":   {"69DAD710-2CE4-4E3C-B16C-21A1D49ABED3", "8307", "root-arm"},
+	"armel":   {"69DAD710-2CE4-4E3C-B16C-21A1D49ABED3", "8307", "root-arm"},
+	"i386":    {"44479540-F297-41B2-9AF7-D131D5F0458A", "8303", "root-x86"},
+	"riscv64": {"72EC70A6-CF74-40E6-BD49-4BDA08E8F224", "", "root-riscv64"},
+	"ppc64el": {"C31C45E6-3F39-412E-80FB-4809C4980599", "", "root-ppc64-le"},
+}
+
+func newGrowRootAction() *GrowRootAction {
+	return &GrowRootAction{Method: "service"}
+}
+
+func (gr *GrowRootAction) Verify(context *DebosContext) error {
+	switch gr.Method {
+	case "service":
+		return nil
+	case "repart":
+		return gr.checkRepartRoot(context)
+	}
+	return fmt.Errorf("Unknown grow method %s", gr.Method)
+}
+
+/* systemd-repart would add a partition rather than grow one of another type,
+ * so only the last partition with the root type will do */
+func (gr *GrowRootAction) checkRepartRoot(context *DebosContext) error {
+	i := context.imageLayout
+	if i == nil {
+		return errors.New("Growing with repart needs the image-partition action first")
+	}
+	if i.PartitionType != "gpt" {
+		return errors.New("Growing with repart needs a gpt image")
+	}
+
+	var root *Partition
+	for _, m := range i.Mountpoints {
+		if m.Mountpoint == "/" {
+			root = m.part
+		}
+	}
+	if root == nil {
+		return errors.New("Growing with repart needs a / mountpoint")
+	}
+	for _, p := range i.Partitions {
+		if p.number > root.number {
+			return fmt.Errorf("Root partition %s has to be the last one to grow", root.Name)
+		}
+	}
+
+	arch, ok := growRootTypes[context.Architecture]
+	if !ok {
+		return fmt.Errorf("No discoverable root partition type for %s", context.Architecture)
+	}
+
+	if i.Backend == "repart" {
+		t := i.repartType(root)
+		if t != "root" && t != arch.repart {
+			return fmt.Errorf("Root partition %s has type %s, not root", root.Name, t)
+		}
+		gr.rootType = t
+		return nil
+	}
+
+	for _, f := range root.SgdiskFlags {
+		if !strings.HasPrefix(f, "typecode=") {
+			continue
+		}
+		code := strings.ToUpper(strings.TrimPrefix(f, "typecode="))
+		if code == arch.guid || (arch.code != "" && code == arch.code) {
+			gr.rootType = arch.guid
+			return nil
+		}
+	}
+	return fmt.Errorf("Root partition %s needs typecode=%s for systemd-repart to grow it",
+		root.Name, arch.guid)
+}
+
+func writeRootFile(rootdir, file, content string, mode os.FileMode) error {
+	dst := path.Join(rootdir, file)
+	err := os.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dst, []byte(content), mode)
+	if err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", file, err)
+	}
+	return nil
+}
+
+func (gr *GrowRootAction) Run(context *DebosContext) error {
+	gr.LogStart()
+
+	if gr.Method == "repart" {
+		err := writeRootFile(context.rootdir, "etc/repart.d/50-root.conf",
+			fmt.Sprintf("[Partition]\nType=%s\n", gr.rootType), 0644)
+		if err != nil {
+			return err
+		}
+		/* systemd-growfs is set up by the fstab option */
+		return editFstabEntry(context.rootdir, "/", func(fields []string) {
+			if !strings.Contains(fields[3], "x-systemd.growfs") {
+				fields[3] += ",x-systemd.growfs"
+			}
+		})
+	}
+
+	files := []struct {
+		file, content string
+		mode          os.FileMode
+	}{
+		{"usr/sbin/debos-grow-root", growRootScript, 0755},
+		{"etc/systemd/system/debos-grow-root.service", growRootService, 0644},
+		{growRootMarker, "", 0644},
+	}
+	for _, f := range files {
+		err := writeRootFile(context.rootdir, f.file, f.content, f.mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return Command{}.Run("systemctl", "systemctl", "--root", context.rootdir,
+		"enable", "debos-grow-root.service")
+}
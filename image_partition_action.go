@@ -1,69 +1,284 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/docker/go-units"
 	"github.com/debos/fakemachine"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
 )
 
 type Partition struct {
-	number int
-	Name   string
-	Start  string
-	End    string
-	FS     string
-	Flags  []string
-	FSUUID string
+	number   int
+	Number   int // Partition number, defaults to the position in the list
+	Name     string
+	Start    string
+	End      string
+	FS       string
+	PartedFS string // fs-type hint for parted, "none" to leave it out; guessed from fs
+	Flags    []string
+	FSUUID   string
+	HashSeed string // ext2/3/4 directory hash seed
+	Inodes   int    // ext2/3/4 inode count
+	UUID     string // GPT partition guid (PARTUUID), random by default
+	partUUID string // Partition uuid, for filesystems without one
+
+	FatSize    int // 12, 16 or 32, up to mkfs.vfat by default
+	FatCluster int // Sectors per cluster
+
+	Source   string // Image to write verbatim instead of formatting, relative to the recipe or from a filesystem action
+	built    bool   // Source is in the artifact directory, from a filesystem action
+	NoFormat bool   // Keep the filesystem already on the partition of an existing image
+	ESP      bool   // EFI system partition: esp flag, type guid and fat32 unless given otherwise
+
+	Type   string   // repart partition type, guessed from the mountpoint by default
+	Repart []string // Extra repart.d settings, e.g. NoAuto=yes
+
+	Attributes  []int    // GPT attribute bits, e.g. 60 for read-only
+	SgdiskFlags []string // sgdisk options, e.g. typecode=8304
+
+	StagingOptions []string // Mount options while populating the image
+	StagingRO      bool     `yaml:"staging_ro"`
+}
+
+/* The staging mount only follows the staging options, the fstab options
+ * (e.g. ro) only apply once the image boots */
+func (p *Partition) stagingMountOptions() (uintptr, string) {
+	flags, data := parseMountOptions(p.StagingOptions)
+	if p.StagingRO {
+		flags |= syscall.MS_RDONLY
+	}
+	return flags, data
+}
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+/* Filesystems a typical distribution kernel can mount as root without help
+ * from an initramfs */
+var rootFilesystems = map[string]bool{
+	"ext2": true, "ext3": true, "ext4": true, "btrfs": true, "xfs": true,
+}
+
+/* Filesystems parted takes as mkpart fs-type hint. The hint only picks the
+ * partition type, so for others it is better left out */
+var partedFilesystems = map[string]bool{
+	"btrfs": true, "ext2": true, "ext3": true, "ext4": true, "fat16": true,
+	"fat32": true, "hfs": true, "hfs+": true, "linux-swap": true, "ntfs": true,
+	"udf": true, "xfs": true,
+}
+
+func (p *Partition) partedFSHint() string {
+	switch {
+	case p.PartedFS == "none":
+		return ""
+	case p.PartedFS != "":
+		return p.PartedFS
+	case partedFilesystems[p.FS]:
+		return p.FS
+	}
+	return ""
+}
+
+func isExtFS(fs string) bool {
+	return fs == "ext2" || fs == "ext3" || fs == "ext4"
 }
 
 type Mountpoint struct {
 	Mountpoint string
 	Partition  string
 	Options    []string
+	MountBy    string // uuid (of the filesystem, the default) or partuuid
 	part       *Partition
 }
 
+/* Whether the fstab and kernel commandline refer to the partition rather
+ * than its filesystem */
+func (m Mountpoint) byPartUUID() bool {
+	return m.MountBy == "partuuid" || m.part.FS == "squashfs"
+}
+
+/* Writable overlay on top of a (typically read-only) directory, with the
+ * upper and work directories kept below Upper on a writable mountpoint. The
+ * overlay is mounted from the fstab once booted, so can't cover anything the
+ * system needs before that */
+type Overlay struct {
+	Mountpoint string
+	Upper      string
+}
+
+/* In use before the fstab gets mounted, or not on disk at all */
+var overlayEarlyDirs = []string{"/etc", "/usr", "/bin", "/sbin", "/lib", "/lib32",
+	"/lib64", "/libx32", "/boot", "/dev", "/proc", "/run", "/sys"}
+
+func overlayAllowed(mountpoint string) bool {
+	if mountpoint == "/" || mountpoint == "/var" {
+		return false
+	}
+	for _, d := range overlayEarlyDirs {
+		if mountpoint == d || strings.HasPrefix(mountpoint, d+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+/* Read-only filesystems can't be formatted up front and populated. Their
+ * mountpoint is a plain directory while staging, from which the filesystem
+ * is built once the image is done, so the partition holding the directory
+ * needs room for the content in the meantime */
+func isReadOnlyFS(fs string) bool {
+	return fs == "squashfs" || fs == "erofs"
+}
+
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
 type ImagePartitionAction struct {
 	BaseAction    `yaml:",inline"`
 	ImageName     string
 	ImageSize     string
 	PartitionType string
+	SectorSize    int    // Logical sector size, other than 512 only without fakemachine
+	Clone         string // Image or device to copy the partition table from
+	Sfdisk        string // sfdisk script to apply verbatim
+	Backend       string // parted or repart, which lays partitions out in order
+	Slack         *int   // Percent headroom over the content with an auto imagesize
+	MaxSize       string // Upper bound of an auto imagesize
+	FormatJobs    int    // Partitions formatted concurrently
+	UUIDTimeout   int    // Seconds to wait for blkid to find a new filesystem
+	ExpandGPT     bool   // Mark the image to move the backup GPT on first boot
+	Wipe          bool   // Clear old signatures first, needs --allow-wipe
+	Fsck          bool   // Check the populated filesystems once unmounted
 	Partitions    []Partition
 	Mountpoints   []Mountpoint
+	Overlays      []Overlay
 	size          int64
 	usingLoop     bool
+	sfdiskTable   string // sfdisk input used instead of parted
+}
+
+/* Everything wrong with the fstab to be, rather than just the first thing */
+func (i *ImagePartitionAction) checkFSTab(context *DebosContext) error {
+	var problems []string
+	mounted := make(map[string]bool)
+	uuids := make(map[string]string)
+	root := false
+
+	for _, m := range i.Mountpoints {
+		if mounted[m.Mountpoint] {
+			problems = append(problems, fmt.Sprintf("%s is mounted more than once", m.Mountpoint))
+		}
+		mounted[m.Mountpoint] = true
+		root = root || m.Mountpoint == "/"
+
+		uuid := m.part.FSUUID
+		if m.byPartUUID() {
+			uuid = m.part.partUUID
+		}
+		if uuid == "" {
+			problems = append(problems, fmt.Sprintf("no uuid captured for partition %s", m.part.Name))
+			continue
+		}
+		if other, ok := uuids[uuid]; ok && other != m.part.Name {
+			problems = append(problems, fmt.Sprintf("partitions %s and %s share uuid %s",
+				other, m.part.Name, uuid))
+		}
+		uuids[uuid] = m.part.Name
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid fstab: %s", strings.Join(problems, "; "))
+	}
+
+	if !root && len(i.Mountpoints) > 0 {
+		return context.Warn("No / in the fstab")
+	}
+
+	return nil
 }
 
 func (i *ImagePartitionAction) generateFSTab(context *DebosContext) error {
 	context.imageFSTab.Reset()
 
+	err := i.checkFSTab(context)
+	if err != nil {
+		return err
+	}
+
 	for _, m := range i.Mountpoints {
 		options := []string{"defaults"}
 		options = append(options, m.Options...)
-		if m.part.FSUUID == "" {
-			return fmt.Errorf("Missing fs UUID for partition %s!?!", m.part.Name)
+		source := fmt.Sprintf("UUID=%s", m.part.FSUUID)
+		if m.byPartUUID() {
+			source = fmt.Sprintf("PARTUUID=%s", m.part.partUUID)
 		}
-		context.imageFSTab.WriteString(fmt.Sprintf("UUID=%s\t%s\t%s\t%s\t0\t0\n",
-			m.part.FSUUID, m.Mountpoint, m.part.FS,
+		if isReadOnlyFS(m.part.FS) {
+			options = append(options, "ro")
+			/* A separate /usr has to be there before switching root */
+			if m.Mountpoint == "/usr" {
+				options = append(options, "x-initrd.mount")
+			}
+		}
+		context.imageFSTab.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t0\t0\n",
+			source, m.Mountpoint, m.part.FS,
 			strings.Join(options, ",")))
 	}
 
+	/* The lower directory is the mountpoint itself, as found in the image */
+	for _, o := range i.Overlays {
+		options := []string{
+			fmt.Sprintf("lowerdir=%s", o.Mountpoint),
+			fmt.Sprintf("upperdir=%s", path.Join(o.Upper, "upper")),
+			fmt.Sprintf("workdir=%s", path.Join(o.Upper, "work")),
+			fmt.Sprintf("x-systemd.requires-mounts-for=%s", o.Upper),
+		}
+		context.imageFSTab.WriteString(fmt.Sprintf("overlay\t%s\toverlay\t%s\t0\t0\n",
+			o.Mountpoint, strings.Join(options, ",")))
+	}
+
 	return nil
 }
 
 func (i *ImagePartitionAction) generateKernelRoot(context *DebosContext) error {
 	for _, m := range i.Mountpoints {
 		if m.Mountpoint == "/" {
-			if m.part.FSUUID == "" {
+			if m.part.FSUUID == "" && !m.byPartUUID() {
 				return errors.New("No fs UUID for root partition !?!")
 			}
 			context.imageKernelRoot = fmt.Sprintf("root=UUID=%s", m.part.FSUUID)
+			if m.byPartUUID() {
+				context.imageKernelRoot = fmt.Sprintf("root=PARTUUID=%s", m.part.partUUID)
+			}
+			if isReadOnlyFS(m.part.FS) {
+				context.imageKernelRoot += " ro"
+			}
 			break
 		}
 	}
@@ -82,6 +297,33 @@ func (i ImagePartitionAction) getPartitionDevice(number int, context DebosContex
 	}
 }
 
+/* Options for mkfs so the filesystem block size is never smaller than the
+ * logical sector size of the device. ext and btrfs use 4096 byte blocks by
+ * default, so only need telling for larger sectors */
+func (i ImagePartitionAction) sectorSizeOptions(fs string) []string {
+	if i.SectorSize == 512 {
+		return nil
+	}
+
+	size := fmt.Sprintf("%d", i.SectorSize)
+	switch fs {
+	case "fat32":
+		return []string{"-S", size}
+	case "ext2", "ext3", "ext4":
+		if i.SectorSize > 4096 {
+			return []string{"-b", size}
+		}
+	case "btrfs":
+		if i.SectorSize > 4096 {
+			return []string{"--sectorsize", size}
+		}
+	case "xfs":
+		return []string{"-s", "size=" + size}
+	}
+
+	return nil
+}
+
 func (i ImagePartitionAction) PreMachine(context *DebosContext, m *fakemachine.Machine,
 	args *[]string) error {
 	err := m.CreateImage(i.ImageName, i.size)
@@ -89,6 +331,19 @@ func (i ImagePartitionAction) PreMachine(context *DebosContext, m *fakemachine.M
 		return err
 	}
 
+	if i.Clone != "" {
+		m.AddVolume(path.Dir(CleanPathAt(i.Clone, context.recipeDir)))
+	}
+	if i.Sfdisk != "" {
+		m.AddVolume(path.Dir(CleanPathAt(i.Sfdisk, context.recipeDir)))
+	}
+	/* The artifact directory is shared with the machine anyway */
+	for _, p := range i.Partitions {
+		if p.Source != "" && !p.built {
+			m.AddVolume(path.Dir(p.Source))
+		}
+	}
+
 	context.image = "/dev/vda"
 	*args = append(*args, "--internal-image", "/dev/vda")
 	return nil
@@ -98,172 +353,1671 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context DebosContext
 	label := fmt.Sprintf("Formatting partition %d", p.number)
 	path := i.getPartitionDevice(p.number, context)
 
+	if p.Source != "" {
+		return i.writeSource(p, path)
+	}
+
+	if p.NoFormat {
+		return i.keepFilesystem(p, path)
+	}
+
+	if isReadOnlyFS(p.FS) {
+		return i.prepareReadOnly(p, path)
+	}
+
 	cmdline := []string{}
 	switch p.FS {
 	case "fat32":
 		cmdline = append(cmdline, "mkfs.vfat", "-n", p.Name)
+		if p.FatSize != 0 {
+			cmdline = append(cmdline, "-F", fmt.Sprintf("%d", p.FatSize))
+		}
+		if p.FatCluster != 0 {
+			cmdline = append(cmdline, "-s", fmt.Sprintf("%d", p.FatCluster))
+		}
+	case "f2fs":
+		cmdline = append(cmdline, "mkfs.f2fs", "-l", p.Name)
 	default:
 		cmdline = append(cmdline, fmt.Sprintf("mkfs.%s", p.FS), "-L", p.Name)
 	}
+	cmdline = append(cmdline, i.sectorSizeOptions(p.FS)...)
+	if isExtFS(p.FS) {
+		/* Fixed uuid, hash seed and inode count make for reproducible
+		 * filesystem metadata */
+		if p.FSUUID != "" {
+			cmdline = append(cmdline, "-U", p.FSUUID)
+		}
+		if p.HashSeed != "" {
+			cmdline = append(cmdline, "-E", fmt.Sprintf("hash_seed=%s", p.HashSeed))
+		}
+		if p.Inodes != 0 {
+			cmdline = append(cmdline, "-N", fmt.Sprintf("%d", p.Inodes))
+		}
+	}
 	cmdline = append(cmdline, path)
 
-	Command{}.Run(label, cmdline...)
+	err := Command{}.Run(label, cmdline...)
+	if err != nil {
+		return fmt.Errorf("Partition %s: mkfs failed: %v", p.Name, err)
+	}
 
-	uuid, err := exec.Command("blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", path).Output()
+	uuid, err := waitForUUID(path, time.Duration(i.UUIDTimeout)*time.Second)
 	if err != nil {
-		return fmt.Errorf("Failed to get uuid: %s", err)
+		return fmt.Errorf("Partition %s: %v", p.Name, err)
 	}
-	p.FSUUID = strings.TrimSpace(string(uuid[:]))
+	p.FSUUID = uuid
 
 	return nil
 }
 
-func (i ImagePartitionAction) PreNoMachine(context *DebosContext) error {
-
-	img, err := os.OpenFile(i.ImageName, os.O_WRONLY|os.O_CREATE, 0666)
+/* Keep the filesystem on a partition of an existing image, it only has to be
+ * what the recipe expects */
+func (i ImagePartitionAction) keepFilesystem(p *Partition, device string) error {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", "-p", "-c", "none", device).Output()
 	if err != nil {
-		return fmt.Errorf("Couldn't open image file: %v", err)
+		return fmt.Errorf("Partition %s has no filesystem to keep", p.Name)
+	}
+
+	fs := strings.TrimSpace(string(out))
+	expected := p.FS
+	if expected == "fat32" {
+		expected = "vfat"
+	}
+	if fs != expected {
+		return fmt.Errorf("Partition %s holds %s rather than %s", p.Name, fs, p.FS)
 	}
 
-	err = img.Truncate(i.size)
+	uuid, err := waitForUUID(device, time.Duration(i.UUIDTimeout)*time.Second)
 	if err != nil {
-		return fmt.Errorf("Couldn't resize image file: %v", err)
+		return fmt.Errorf("Partition %s: %v", p.Name, err)
+	}
+	p.FSUUID = uuid
+	log.Printf("Keeping %s filesystem %s on partition %s\n", fs, uuid, p.Name)
+
+	return nil
+}
+
+/* Partitions keeping their filesystem need the partition table of the
+ * existing image as it is */
+func (i ImagePartitionAction) keepTable() bool {
+	for _, p := range i.Partitions {
+		if p.NoFormat {
+			return true
+		}
 	}
+	return false
+}
 
-	img.Close()
+func (i *ImagePartitionAction) checkKeepTable() error {
+	if i.Clone != "" || i.Sfdisk != "" || i.Backend == "repart" || i.ImageSize == "auto" || i.Wipe {
+		return errors.New("Partitions without formatting need the existing partition table, " +
+			"so can't be used with clone, sfdisk, repart, wipe or an auto imagesize")
+	}
 
-	loop, err := exec.Command("losetup", "-f", "--show", i.ImageName).Output()
+	st, err := os.Stat(i.ImageName)
 	if err != nil {
-		return fmt.Errorf("Failed to setup loop device")
+		return fmt.Errorf("Partitions without formatting need an existing image: %v", err)
+	}
+	if i.ImageSize == "" {
+		i.ImageSize = fmt.Sprintf("%d", st.Size())
+	}
+	if size, err := units.FromHumanSize(i.ImageSize); err == nil && size < st.Size() {
+		return fmt.Errorf("Image size %s would cut off the end of the existing image", i.ImageSize)
+	}
+
+	for _, p := range i.Partitions {
+		if !p.NoFormat {
+			continue
+		}
+		if p.Source != "" || isReadOnlyFS(p.FS) {
+			return fmt.Errorf("Partition %s: noformat can't be used with a source or %s", p.Name, p.FS)
+		}
+		if p.FSUUID != "" {
+			return fmt.Errorf("Partition %s: noformat keeps the existing fs uuid", p.Name)
+		}
+		if _, _, err := imagePartitionRange(i.ImageName, p.number); err != nil {
+			return fmt.Errorf("Partition %s: %v", p.Name, err)
+		}
 	}
-	context.image = strings.TrimSpace(string(loop[:]))
-	i.usingLoop = true
 
 	return nil
 }
 
-func (i ImagePartitionAction) Run(context *DebosContext) error {
-	i.LogStart()
-	err := Command{}.Run("parted", "parted", "-s", context.image, "mklabel", i.PartitionType)
+/* Write a prebuilt partition image onto the partition. Whatever filesystem
+ * it holds brings its own uuid, which is only needed when it gets mounted */
+func (i ImagePartitionAction) writeSource(p *Partition, device string) error {
+	src, err := os.Open(p.Source)
+	if err != nil {
+		return fmt.Errorf("Partition %s: %v", p.Name, err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Partition %s: %v", p.Name, err)
+	}
+	defer dst.Close()
+
+	st, err := src.Stat()
 	if err != nil {
 		return err
 	}
-	for idx, _ := range i.Partitions {
-		p := &i.Partitions[idx]
-		var name string
-		if i.PartitionType == "gpt" {
-			name = p.Name
-		} else {
-			name = "primary"
-		}
-		err = Command{}.Run("parted", "parted", "-a", "none", "-s", context.image, "mkpart",
-			name, p.FS, p.Start, p.End)
-		if err != nil {
-			return err
-		}
+	size, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if st.Size() > size {
+		return fmt.Errorf("Partition %s: %s is %s but the partition only %s", p.Name, p.Source,
+			units.BytesSize(float64(st.Size())), units.BytesSize(float64(size)))
+	}
 
-		if p.Flags != nil {
-			for _, flag := range p.Flags {
-				err = Command{}.Run("parted", "parted", "-s", context.image, "set",
-					fmt.Sprintf("%d", p.number), flag, "on")
-				if err != nil {
-					return err
-				}
+	_, err = dst.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't write %s to partition %s: %v", p.Source, p.Name, err)
+	}
+
+	switch p.FS {
+	case "":
+		return nil
+	case "squashfs":
+		return i.prepareReadOnly(p, device)
+	}
+	uuid, err := waitForUUID(device, time.Duration(i.UUIDTimeout)*time.Second)
+	if err != nil {
+		return fmt.Errorf("Partition %s: %v", p.Name, err)
+	}
+	p.FSUUID = uuid
+
+	return nil
+}
+
+/* Read-only filesystems only get built at cleanup, but their fstab entry is
+ * needed before. erofs gets a uuid picked now, squashfs has none so the
+ * partition uuid is used instead */
+func (i ImagePartitionAction) prepareReadOnly(p *Partition, device string) error {
+	if p.FS == "erofs" {
+		if p.FSUUID == "" {
+			uuid, err := randomUUID()
+			if err != nil {
+				return err
 			}
+			p.FSUUID = uuid
 		}
+		return nil
+	}
+
+	return p.readPartUUID(device)
+}
+
+func (p *Partition) readPartUUID(device string) error {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "PART_ENTRY_UUID", "-p", "-c", "none",
+		device).Output()
+	p.partUUID = strings.TrimSpace(string(out))
+	if err != nil || p.partUUID == "" {
+		return fmt.Errorf("Couldn't get partition uuid of %s: %v", p.Name, err)
+	}
+
+	return nil
+}
+
+/* Build a read-only filesystem from its staging directory, which is emptied
+ * afterwards so the content doesn't stay behind in the underlying partition */
+func (i ImagePartitionAction) buildReadOnly(m Mountpoint, mntpath string, context DebosContext) error {
+	dev := i.getPartitionDevice(m.part.number, context)
+	label := fmt.Sprintf("Building %s partition %d", m.part.FS, m.part.number)
+
+	var err error
+	switch m.part.FS {
+	case "squashfs":
+		err = Command{}.Run(label, "mksquashfs", mntpath, dev, "-noappend")
+	case "erofs":
+		err = Command{}.Run(label, "mkfs.erofs", "-U", m.part.FSUUID, "-L", m.part.Name, dev, mntpath)
+	}
+	if err != nil {
+		return err
+	}
 
-		err = i.formatPartition(p, *context)
+	entries, err := ioutil.ReadDir(mntpath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = os.RemoveAll(path.Join(mntpath, e.Name()))
 		if err != nil {
 			return err
 		}
 	}
 
-	context.imageMntDir = path.Join(context.scratchdir, "mnt")
-	os.MkdirAll(context.imageMntDir, 755)
-	for _, m := range i.Mountpoints {
-		dev := i.getPartitionDevice(m.part.number, *context)
-		mntpath := path.Join(context.imageMntDir, m.Mountpoint)
-		os.MkdirAll(mntpath, 755)
-		var fs string
-		switch m.part.FS {
-		case "fat32":
-			fs = "vfat"
-		default:
-			fs = m.part.FS
+	return nil
+}
+
+/* Right after mkfs blkid may not see the new filesystem yet on some kernels,
+ * so let udev settle and retry until a UUID shows up */
+func waitForUUID(device string, timeout time.Duration) (string, error) {
+	exec.Command("udevadm", "settle").Run()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := exec.Command("blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", device).Output()
+		uuid := strings.TrimSpace(string(out[:]))
+		if uuid != "" {
+			return uuid, nil
 		}
-		err := syscall.Mount(dev, mntpath, fs, 0, "")
+		if time.Now().After(deadline) {
+			if err != nil {
+				return "", fmt.Errorf("Failed to get uuid: %s", err)
+			}
+			return "", fmt.Errorf("No uuid found on %s after %v", device, timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+/* Every partition is a distinct device, so they can be formatted in
+ * parallel. Each worker only touches its own Partition */
+func (i ImagePartitionAction) formatPartitions(context *DebosContext) error {
+	errs := make([]error, len(i.Partitions))
+	jobs := make(chan struct{}, i.FormatJobs)
+	var wg sync.WaitGroup
+
+	for idx, _ := range i.Partitions {
+		wg.Add(1)
+		jobs <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			errs[idx] = i.formatPartition(&i.Partitions[idx], *context)
+			<-jobs
+		}(idx)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
 		if err != nil {
-			return fmt.Errorf("%s mount failed: %v", m.part.Name, err)
+			return err
 		}
 	}
 
-	err = i.generateFSTab(context)
+	return nil
+}
+
+/* Create the image as a sparse file. Sizes are int64 all the way down, Go
+ * opens with O_LARGEFILE and truncates with ftruncate64 on 32-bit hosts, so
+ * images past 2GiB work there too, nothing may narrow them to int */
+func createImageFile(name string, size int64) error {
+	img, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
-		return err
+		return fmt.Errorf("Couldn't open image file: %v", err)
 	}
+	defer img.Close()
 
-	err = i.generateKernelRoot(context)
+	err = img.Truncate(size)
 	if err != nil {
-		return err
+		return fmt.Errorf("Couldn't resize image file: %v", err)
 	}
 
 	return nil
 }
 
-func (i ImagePartitionAction) Cleanup(context DebosContext) error {
-	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
-		m := i.Mountpoints[idx]
-		mntpath := path.Join(context.imageMntDir, m.Mountpoint)
-		syscall.Unmount(mntpath, 0)
+func (i ImagePartitionAction) PreNoMachine(context *DebosContext) error {
+	err := createImageFile(i.ImageName, i.size)
+	if err != nil {
+		return err
 	}
 
-	if i.usingLoop {
-		exec.Command("losetup", "-d", context.image).Run()
+	losetup := []string{"-f", "--show"}
+	if i.SectorSize != 512 {
+		losetup = append(losetup, "--sector-size", fmt.Sprintf("%d", i.SectorSize))
+	}
+	losetup = append(losetup, i.ImageName)
+
+	loop, err := exec.Command("losetup", losetup...).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to setup loop device")
 	}
+	context.image = strings.TrimSpace(string(loop[:]))
+	i.usingLoop = true
 
 	return nil
 }
 
-func (i *ImagePartitionAction) Verify(context *DebosContext) error {
-	num := 1
-	for idx, _ := range i.Partitions {
-		p := &i.Partitions[idx]
-		p.number = num
-		num++
-		if p.Name == "" {
-			return fmt.Errorf("Partition without a name")
+/* GPT partition names are at most 36 UTF-16 code units. Quotes and control
+ * characters are dropped as parted can't cope with them on its commandline */
+func gptPartitionName(name string) string {
+	var label []rune
+	units := 0
+	for _, r := range name {
+		if r == '"' || r == '\'' || unicode.IsControl(r) {
+			continue
 		}
-		if p.Start == "" {
-			return fmt.Errorf("Partition %s missing start", p.Name)
-		}
-		if p.End == "" {
-			return fmt.Errorf("Partition %s missing end", p.Name)
+		n := len(utf16.Encode([]rune{r}))
+		if units+n > 36 {
+			break
 		}
+		units += n
+		label = append(label, r)
+	}
+	return string(label)
+}
 
-		if p.FS == "" {
-			return fmt.Errorf("Partition %s missing fs type", p.Name)
-		}
+const espTypeGUID = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+
+/* Fill in what an EFI system partition needs that the recipe doesn't set
+ * itself */
+func (i *ImagePartitionAction) setupESP(p *Partition) error {
+	if i.Clone != "" || i.Sfdisk != "" {
+		return fmt.Errorf("Partition %s: esp needs the partition table made from the recipe", p.Name)
 	}
 
-	for idx, _ := range i.Mountpoints {
-		m := &i.Mountpoints[idx]
-		for pidx, _ := range i.Partitions {
-			p := &i.Partitions[pidx]
-			if m.Partition == p.Name {
-				m.part = p
-				break
-			}
-		}
-		if m.part == nil {
-			return fmt.Errorf("Couldn't fount partition for %s", m.Mountpoint)
-		}
+	if p.FS == "" && p.Source == "" {
+		p.FS = "fat32"
+	}
+	if p.FS != "" && p.FS != "fat32" && p.FS != "vfat" {
+		return fmt.Errorf("Partition %s: an EFI system partition needs fat, not %s", p.Name, p.FS)
 	}
 
-	size, err := units.FromHumanSize(i.ImageSize)
-	if err != nil {
-		return fmt.Errorf("Failed to parse image size: %s", i.ImageSize)
+	flagged := false
+	for _, f := range p.Flags {
+		if f == "esp" || (f == "boot" && i.PartitionType == "gpt") {
+			flagged = true
+		}
+	}
+	if !flagged {
+		p.Flags = append(p.Flags, "esp")
+	}
+
+	if i.PartitionType != "gpt" || p.Type != "" {
+		return nil
+	}
+	/* repart sets the type itself */
+	if i.Backend == "repart" {
+		p.Type = "esp"
+		return nil
+	}
+	for _, f := range p.SgdiskFlags {
+		if strings.HasPrefix(f, "typecode=") {
+			return nil
+		}
+	}
+	p.SgdiskFlags = append(p.SgdiskFlags, "typecode="+espTypeGUID)
+
+	return nil
+}
+
+/* repart partition types for the mountpoints they are auto-discovered at */
+var repartMountpointTypes = map[string]string{
+	"/": "root", "/usr": "usr", "/home": "home", "/srv": "srv", "/var": "var",
+	"/var/tmp": "tmp", "/boot": "xbootldr", "/efi": "esp",
+}
+
+func (i ImagePartitionAction) repartType(p *Partition) string {
+	if p.Type != "" {
+		return p.Type
+	}
+	for _, f := range p.Flags {
+		if f == "esp" || f == "boot" {
+			return "esp"
+		}
+	}
+	for _, m := range i.Mountpoints {
+		if t, ok := repartMountpointTypes[m.Mountpoint]; ok && m.part == p {
+			return t
+		}
+	}
+	return "linux-generic"
+}
+
+/* repart only creates the partitions, debos formats and fills them after */
+var repartContentSettings = map[string]bool{
+	"Encrypt": true, "Format": true, "CopyFiles": true, "CopyBlocks": true,
+	"MakeDirectories": true, "Verity": true, "Minimize": true,
+}
+
+/* repart.d definition of a partition. repart lays partitions out by itself
+ * in the order of the definitions, so only the size of the start and end
+ * offsets matters and a start isn't kept; a partition ending at 100% takes
+ * what is left */
+func (i ImagePartitionAction) repartDefinition(p *Partition) string {
+	lines := []string{"[Partition]",
+		"Type=" + i.repartType(p),
+		"Label=" + gptPartitionName(p.Name),
+	}
+
+	start, _ := i.parseOffset(p.Start, i.size)
+	end, _ := i.parseOffset(p.End, i.size)
+	if p.End != "100%" {
+		size := end - start
+		lines = append(lines, fmt.Sprintf("SizeMinBytes=%d", size), fmt.Sprintf("SizeMaxBytes=%d", size))
+	}
+	lines = append(lines, p.Repart...)
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (i ImagePartitionAction) runRepart(context *DebosContext) error {
+	dir, err := ioutil.TempDir(context.scratchdir, "repart-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for idx, _ := range i.Partitions {
+		p := &i.Partitions[idx]
+		file := path.Join(dir, fmt.Sprintf("%02d-%s.conf", p.number, p.Name))
+		err = ioutil.WriteFile(file, []byte(i.repartDefinition(p)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return Command{}.Run("systemd-repart", "systemd-repart", "--empty=force", "--dry-run=no",
+		"--definitions", dir, "--sector-size", fmt.Sprintf("%d", i.SectorSize), context.image)
+}
+
+func (i ImagePartitionAction) createPartitions(context *DebosContext) error {
+	err := Command{}.Run("parted", "parted", "-s", context.image, "mklabel", i.PartitionType)
+	if err != nil {
+		return err
+	}
+	/* Create in number order so parted hands out the intended numbers */
+	order := make([]*Partition, len(i.Partitions))
+	for idx, _ := range i.Partitions {
+		order[i.Partitions[idx].number-1] = &i.Partitions[idx]
+	}
+
+	for _, p := range order {
+		var name string
+		if i.PartitionType == "gpt" {
+			name = gptPartitionName(p.Name)
+		} else {
+			name = "primary"
+		}
+		cmdline := []string{"parted", "-a", "none", "-s", context.image, "mkpart", name}
+		if hint := p.partedFSHint(); hint != "" {
+			cmdline = append(cmdline, hint)
+		}
+		cmdline = append(cmdline, p.Start, p.End)
+		err = Command{}.Run("parted", cmdline...)
+		if err != nil {
+			return err
+		}
+
+		if p.Flags != nil {
+			for _, flag := range p.Flags {
+				err = Command{}.Run("parted", "parted", "-s", context.image, "set",
+					fmt.Sprintf("%d", p.number), flag, "on")
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+/* sgdisk options that can be given per partition, as <option>=<value> */
+var sgdiskOptions = map[string]bool{
+	"typecode": true, "change-name": true, "partition-guid": true, "attributes": true,
+}
+
+/* GPT attribute bits and sgdisk flags, which go beyond what parted knows */
+func (i ImagePartitionAction) runSgdisk(context *DebosContext) error {
+	for _, p := range i.Partitions {
+		var options []string
+		if p.UUID != "" {
+			options = append(options, fmt.Sprintf("--partition-guid=%d:%s", p.number, p.UUID))
+		}
+		for _, bit := range p.Attributes {
+			options = append(options, fmt.Sprintf("--attributes=%d:set:%d", p.number, bit))
+		}
+		for _, f := range p.SgdiskFlags {
+			kv := strings.SplitN(f, "=", 2)
+			options = append(options, fmt.Sprintf("--%s=%d:%s", kv[0], p.number, kv[1]))
+		}
+
+		for _, o := range options {
+			err := Command{}.Run("sgdisk", "sgdisk", o, context.image)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Marker in the root filesystem for a first boot service to run sgdisk -e,
+ * moving the backup GPT to the end of a device larger than the image, and
+ * remove the marker */
+const expandGPTMarker = "var/lib/debos/expand-gpt"
+
+/* Both the primary and backup GPT have to be intact, the backup is what
+ * allows the table to be repaired or moved once the image is on a disk */
+func verifyGPT(image string) error {
+	out, err := exec.Command("sgdisk", "--verify", image).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "No problems found") {
+		return fmt.Errorf("GPT verification failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+/* Read the partition table of the clone source, dropping everything that
+ * identifies the source (device names, disk and partition uuids) or depends
+ * on its size */
+func (i *ImagePartitionAction) readCloneTable(source string) (int, error) {
+	dump, err := exec.Command("sfdisk", "--dump", source).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't read partition table of %s: %v", i.Clone, err)
+	}
+
+	var table []string
+	count := 0
+	for _, l := range strings.Split(string(dump), "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case l == "":
+		case strings.HasPrefix(l, "device:"), strings.HasPrefix(l, "label-id:"),
+			strings.HasPrefix(l, "last-lba:"):
+		case strings.HasPrefix(l, "label:"):
+			label := strings.TrimSpace(strings.TrimPrefix(l, "label:"))
+			if label == "dos" {
+				label = "msdos"
+			}
+			if i.PartitionType != "" && i.PartitionType != label {
+				return 0, fmt.Errorf("%s has a %s label, not %s", i.Clone, label, i.PartitionType)
+			}
+			i.PartitionType = label
+			table = append(table, l)
+		case strings.Contains(l, ":") && strings.Contains(l, "start="):
+			fields := strings.Split(l[strings.Index(l, ":")+1:], ",")
+			var kept []string
+			for _, f := range fields {
+				if !strings.HasPrefix(strings.TrimSpace(f), "uuid=") {
+					kept = append(kept, strings.TrimSpace(f))
+				}
+			}
+			table = append(table, strings.Join(kept, ", "))
+			count++
+		default:
+			table = append(table, l)
+		}
+	}
+
+	i.sfdiskTable = strings.Join(table, "\n") + "\n"
+	return count, nil
+}
+
+/* Use an sfdisk script as is. Partitions are numbered as the script has
+ * them, which has to match the order they're declared in */
+func (i *ImagePartitionAction) readSfdiskScript(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't read sfdisk script: %v", err)
+	}
+
+	for _, l := range strings.Split(string(content), "\n") {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "label:") && i.PartitionType == "" {
+			i.PartitionType = strings.TrimSpace(strings.TrimPrefix(l, "label:"))
+			if i.PartitionType == "dos" {
+				i.PartitionType = "msdos"
+			}
+		}
+	}
+
+	i.sfdiskTable = string(content)
+	return nil
+}
+
+/* Number of partitions in the table of an image or device */
+func countPartitions(image string) (int, error) {
+	out, err := exec.Command("sfdisk", "--json", image).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't read partition table of %s: %v", image, err)
+	}
+
+	var table struct {
+		PartitionTable struct {
+			Partitions []interface{} `json:"partitions"`
+		} `json:"partitiontable"`
+	}
+	err = json.Unmarshal(out, &table)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(table.PartitionTable.Partitions), nil
+}
+
+func (i ImagePartitionAction) applyPartitionTable(context *DebosContext) error {
+	cmd := exec.Command("sfdisk", context.image)
+	cmd.Stdin = strings.NewReader(i.sfdiskTable)
+	w := newCommandWrapper("sfdisk", nil)
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	err := cmd.Run()
+	w.flush()
+
+	return err
+}
+
+/* An existing image file is reused as is, so old partition table and
+ * filesystem signatures can survive and confuse tools later on */
+func (i ImagePartitionAction) wipe(context *DebosContext) error {
+	out, err := exec.Command("wipefs", "--no-act", "--all", context.image).Output()
+	if err != nil {
+		return fmt.Errorf("Couldn't check %s for signatures: %v", context.image, err)
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		log.Printf("No old signatures found on %s\n", i.ImageName)
+		return nil
+	}
+
+	return Command{}.Run("wipefs", "wipefs", "--all", "--force", context.image)
+}
+
+func (i ImagePartitionAction) Run(context *DebosContext) error {
+	i.LogStart()
+	var err error
+
+	if i.Wipe {
+		err = i.wipe(context)
+		if err != nil {
+			return err
+		}
+	}
+	if i.ImageSize == "auto" {
+		err = i.autoSize(context)
+		if err != nil {
+			return err
+		}
+	}
+	if i.keepTable() {
+		log.Printf("Keeping the partition table of %s\n", i.ImageName)
+	} else if i.sfdiskTable != "" {
+		err = i.applyPartitionTable(context)
+	} else if i.Backend == "repart" {
+		err = i.runRepart(context)
+	} else {
+		err = i.createPartitions(context)
+	}
+	if err != nil {
+		return err
+	}
+
+	if i.Sfdisk != "" {
+		count, err := countPartitions(context.image)
+		if err != nil {
+			return err
+		}
+		if count != len(i.Partitions) {
+			return fmt.Errorf("%s created %d partitions but %d are declared",
+				i.Sfdisk, count, len(i.Partitions))
+		}
+	}
+
+	err = i.runSgdisk(context)
+	if err != nil {
+		return err
+	}
+
+	if i.PartitionType == "gpt" {
+		err = verifyGPT(context.image)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = i.formatPartitions(context)
+	if err != nil {
+		return err
+	}
+	for _, m := range i.Mountpoints {
+		if m.byPartUUID() && m.part.partUUID == "" {
+			err = m.part.readPartUUID(i.getPartitionDevice(m.part.number, *context))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	context.SetValue("image.file", i.ImageName)
+	for _, p := range i.Partitions {
+		if p.FSUUID != "" {
+			context.SetValue(fmt.Sprintf("partition.%s.fsuuid", p.Name), p.FSUUID)
+		}
+		if p.partUUID != "" {
+			context.SetValue(fmt.Sprintf("partition.%s.partuuid", p.Name), p.partUUID)
+		}
+	}
+	for _, m := range i.Mountpoints {
+		context.SetValue(fmt.Sprintf("partition.%s.mountpoint", m.part.Name), m.Mountpoint)
+	}
+
+	context.imageMntDir = path.Join(context.scratchdir, "mnt")
+	os.MkdirAll(context.imageMntDir, 0755)
+	for _, m := range i.Mountpoints {
+		dev := i.getPartitionDevice(m.part.number, *context)
+		mntpath := path.Join(context.imageMntDir, m.Mountpoint)
+		os.MkdirAll(mntpath, 0755)
+		if isReadOnlyFS(m.part.FS) || m.part.Source != "" {
+			continue
+		}
+		var fs string
+		switch m.part.FS {
+		case "fat32":
+			fs = "vfat"
+		default:
+			fs = m.part.FS
+		}
+		flags, data := m.part.stagingMountOptions()
+		err := syscall.Mount(dev, mntpath, fs, flags, data)
+		if err != nil {
+			if len(m.part.StagingOptions) > 0 {
+				return fmt.Errorf("%s mount with options %s failed: %v", m.part.Name,
+					strings.Join(m.part.StagingOptions, ","), err)
+			}
+			return fmt.Errorf("%s mount failed: %v", m.part.Name, err)
+		}
+	}
+
+	for _, o := range i.Overlays {
+		for _, d := range []string{"upper", "work"} {
+			err = os.MkdirAll(path.Join(context.imageMntDir, o.Upper, d), 0755)
+			if err != nil {
+				return fmt.Errorf("Couldn't create overlay directory for %s: %v", o.Mountpoint, err)
+			}
+		}
+	}
+
+	err = i.generateFSTab(context)
+	if err != nil {
+		return err
+	}
+
+	if i.ExpandGPT {
+		marker := path.Join(context.imageMntDir, expandGPTMarker)
+		os.MkdirAll(path.Dir(marker), 0755)
+		err = ioutil.WriteFile(marker, nil, 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't write %s: %v", expandGPTMarker, err)
+		}
+	}
+
+	err = i.generateKernelRoot(context)
+	if err != nil {
+		return err
+	}
+	context.SetValue("image.kernel-root", context.imageKernelRoot)
+
+	return nil
+}
+
+func (i ImagePartitionAction) Cleanup(context DebosContext) error {
+	var failed []string
+	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
+		m := i.Mountpoints[idx]
+		mntpath := path.Join(context.imageMntDir, m.Mountpoint)
+		if m.part.Source != "" {
+			continue
+		}
+		if isReadOnlyFS(m.part.FS) {
+			err := i.buildReadOnly(m, mntpath, context)
+			if err != nil {
+				log.Printf("Building %s failed: %v", m.Mountpoint, err)
+				failed = append(failed, m.Mountpoint)
+			}
+			continue
+		}
+		err := unmount(mntpath, context.killBusy)
+		if err != nil {
+			log.Printf("Unmount failure: %v", err)
+			failed = append(failed, m.Mountpoint)
+		}
+	}
+
+	if i.Fsck && len(failed) == 0 {
+		failed = i.fsck(context)
+	}
+
+	if i.usingLoop {
+		exec.Command("losetup", "-d", context.image).Run()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Couldn't finish %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+/* Read-only check of the filesystems that got populated, returning the
+ * mountpoints of those with errors. Filesystems without a fsck are skipped */
+func (i ImagePartitionAction) fsck(context DebosContext) []string {
+	var failed []string
+	for _, m := range i.Mountpoints {
+		if m.part.Source != "" || isReadOnlyFS(m.part.FS) {
+			continue
+		}
+
+		fs := m.part.FS
+		if fs == "fat32" {
+			fs = "vfat"
+		}
+		tool, err := exec.LookPath("fsck." + fs)
+		if err != nil {
+			log.Printf("No fsck for %s, not checking %s\n", m.part.FS, m.Mountpoint)
+			continue
+		}
+
+		label := fmt.Sprintf("Checking %s", m.Mountpoint)
+		err = Command{}.Run(label, tool, "-n", i.getPartitionDevice(m.part.number, context))
+		if err != nil {
+			log.Printf("Filesystem check of %s failed: %v", m.Mountpoint, err)
+			failed = append(failed, m.Mountpoint)
+		}
+	}
+
+	return failed
+}
+
+var partedUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000}, {"B", 1},
+}
+
+/* Resolve a parted offset to bytes, with percentages relative to the image
+ * size. Returns false for anything too fancy to resolve */
+func (i ImagePartitionAction) parseOffset(offset string, imageSize int64) (int64, bool) {
+	parse := func(s string) (int64, bool) {
+		n, err := strconv.ParseInt(s, 10, 64)
+		return n, err == nil
+	}
+
+	switch {
+	case strings.HasSuffix(offset, "%"):
+		n, ok := parse(strings.TrimSuffix(offset, "%"))
+		return imageSize * n / 100, ok
+	case strings.HasSuffix(offset, "s"):
+		n, ok := parse(strings.TrimSuffix(offset, "s"))
+		return n * int64(i.SectorSize), ok
+	}
+
+	for _, u := range partedUnits {
+		if strings.HasSuffix(offset, u.suffix) {
+			n, ok := parse(strings.TrimSuffix(offset, u.suffix))
+			return n * u.size, ok
+		}
+	}
+
+	/* parted defaults to MB */
+	n, ok := parse(offset)
+	return n * 1000 * 1000, ok
+}
+
+/* Check a parted offset lands on a logical sector boundary; offsets given
+ * in sectors or percentages are left to parted */
+func (i ImagePartitionAction) checkAlignment(offset string) error {
+	if strings.HasSuffix(offset, "s") || strings.HasSuffix(offset, "%") {
+		return nil
+	}
+
+	n, ok := i.parseOffset(offset, 0)
+	if ok && n%int64(i.SectorSize) != 0 {
+		return fmt.Errorf("%s isn't aligned to the %d byte sector size", offset, i.SectorSize)
+	}
+
+	return nil
+}
+
+/* Rough minimum partition sizes mkfs accepts for a filesystem */
+var filesystemMinSize = map[string]int64{
+	"fat32": 1 << 20,
+	"ext2":  1 << 20,
+	"ext3":  2 << 20,
+	"ext4":  2 << 20,
+	"btrfs": 114 << 20,
+	"xfs":   300 << 20,
+}
+
+/* Check the declared partitions fit the image and are big enough for their
+ * filesystems, so this doesn't fail somewhere deep in parted or mkfs */
+func (i ImagePartitionAction) checkSizes() error {
+	var required, relative, deficit int64
+	var problems []string
+
+	for _, p := range i.Partitions {
+		start, okStart := i.parseOffset(p.Start, i.size)
+		end, okEnd := i.parseOffset(p.End, i.size)
+		if !okStart || !okEnd {
+			continue
+		}
+
+		/* parted keeps percentages clear of the backup gpt by itself */
+		if strings.HasSuffix(p.End, "%") {
+			if end > relative {
+				relative = end
+			}
+		} else if end > required {
+			required = end
+		}
+
+		if p.Source != "" {
+			st, err := os.Stat(p.Source)
+			if err == nil && st.Size() > end-start {
+				problems = append(problems, fmt.Sprintf("partition %s is %s but its source %s is %s",
+					p.Name, units.BytesSize(float64(end-start)), p.Source,
+					units.BytesSize(float64(st.Size()))))
+				deficit += st.Size() - (end - start)
+			}
+			continue
+		}
+
+		min := filesystemMinSize[p.FS]
+		if end-start < min {
+			problems = append(problems, fmt.Sprintf("partition %s is %s but %s needs at least %s",
+				p.Name, units.BytesSize(float64(end-start)), p.FS, units.BytesSize(float64(min))))
+			deficit += min - (end - start)
+		}
+	}
+
+	/* Room for the backup table at the end of the disk */
+	if i.PartitionType == "gpt" && required > 0 {
+		required += 33 * int64(i.SectorSize)
+	}
+	if relative > required {
+		required = relative
+	}
+
+	if required > i.size {
+		problems = append(problems, fmt.Sprintf("partitions need %s but the image is %s",
+			units.BytesSize(float64(required)), i.ImageSize))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Image too small: %s; use an imagesize of at least %s",
+			strings.Join(problems, ", "), units.BytesSize(float64(required+deficit)))
+	}
+
+	return nil
+}
+
+/* Cluster counts each FAT type can address */
+var fatClusters = map[int]struct{ min, max int64 }{
+	12: {1, 4084},
+	16: {4085, 65524},
+	32: {65525, 0x0ffffff5},
+}
+
+/* Whether a FAT of the given type fits in size bytes with one of the
+ * cluster sizes, ignoring the little room reserved sectors and the FATs
+ * take */
+func (i ImagePartitionAction) fatFits(size int64, fatSize int, clusters []int) bool {
+	limits := fatClusters[fatSize]
+	for _, c := range clusters {
+		n := size / (int64(c) * int64(i.SectorSize))
+		if n >= limits.min && n <= limits.max {
+			return true
+		}
+	}
+	return false
+}
+
+/* Check the FAT type and cluster size go together with the partition size.
+ * ESPs without an explicit FAT type get FAT32 if it fits and FAT16
+ * otherwise, mkfs.vfat would pick FAT12 for small ones, which some
+ * firmware refuses to boot from */
+func (i *ImagePartitionAction) checkFat() error {
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		if p.FS != "fat32" || p.Source != "" {
+			continue
+		}
+
+		start, okStart := i.parseOffset(p.Start, i.size)
+		end, okEnd := i.parseOffset(p.End, i.size)
+		if !okStart || !okEnd {
+			continue
+		}
+
+		clusters := []int{1, 2, 4, 8, 16, 32, 64, 128}
+		if p.FatCluster != 0 {
+			clusters = []int{p.FatCluster}
+		}
+
+		if p.FatSize == 0 {
+			esp := false
+			for _, f := range p.Flags {
+				esp = esp || f == "esp"
+			}
+			if !esp {
+				continue
+			}
+			if i.fatFits(end-start, 32, clusters) {
+				p.FatSize = 32
+			} else {
+				p.FatSize = 16
+			}
+		}
+
+		if !i.fatFits(end-start, p.FatSize, clusters) {
+			return fmt.Errorf("Partition %s: a %s FAT%d can't have %v sectors per cluster",
+				p.Name, units.BytesSize(float64(end-start)), p.FatSize, clusters)
+		}
+	}
+
+	return nil
+}
+
+func (i *ImagePartitionAction) checkAutoSize() error {
+	if i.Clone != "" || i.Sfdisk != "" {
+		return errors.New("An auto imagesize can't be used with clone or sfdisk")
+	}
+	if i.Slack == nil {
+		slack := 20
+		i.Slack = &slack
+	}
+	if *i.Slack < 0 {
+		return fmt.Errorf("Invalid slack %d%%", *i.Slack)
+	}
+	if i.MaxSize == "" {
+		i.MaxSize = "64GiB"
+	}
+
+	for _, p := range i.Partitions {
+		mounted := false
+		for _, m := range i.Mountpoints {
+			mounted = mounted || m.Partition == p.Name
+		}
+		if p.Start == "" && (!mounted || p.Source != "") {
+			return fmt.Errorf("Partition %s has no content to size it by, give it a start and end", p.Name)
+		}
+		if p.Start == "" {
+			continue
+		}
+		_, okStart := i.parseOffset(p.Start, 0)
+		_, okEnd := i.parseOffset(p.End, 0)
+		if !okStart || !okEnd || strings.HasSuffix(p.Start, "%") || strings.HasSuffix(p.End, "%") {
+			return fmt.Errorf("Partition %s: an auto imagesize needs fixed starts and ends", p.Name)
+		}
+	}
+
+	return nil
+}
+
+/* Space the staged content takes on each mounted partition, each file
+ * counting for the deepest mountpoint it is below */
+func (i ImagePartitionAction) stagedUsage(rootdir string) (map[string]int64, error) {
+	usage := make(map[string]int64)
+	walker := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(p, rootdir), "/")
+
+		var part string
+		depth := -1
+		for _, m := range i.Mountpoints {
+			if (rel == m.Mountpoint || strings.HasPrefix(rel, strings.TrimSuffix(m.Mountpoint, "/")+"/")) &&
+				len(m.Mountpoint) > depth {
+				part, depth = m.Partition, len(m.Mountpoint)
+			}
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage[part] += st.Blocks * 512
+		}
+		return nil
+	}
+
+	return usage, filepath.Walk(rootdir, walker)
+}
+
+/* Lay the partitions out one after the other, with those having a start and
+ * end keeping that size and the others sized by their content plus slack.
+ * The image gets cut down to fit once it is complete */
+func (i ImagePartitionAction) autoSize(context *DebosContext) error {
+	usage, err := i.stagedUsage(context.rootdir)
+	if err != nil {
+		return fmt.Errorf("Couldn't measure the staged content: %v", err)
+	}
+
+	const mib = 1 << 20
+	offset := int64(mib)
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		var size int64
+		if p.Start != "" {
+			start, _ := i.parseOffset(p.Start, 0)
+			end, _ := i.parseOffset(p.End, 0)
+			size = end - start
+		} else {
+			/* Room for the filesystem's own metadata on top */
+			size = usage[p.Name]*int64(100+*i.Slack)/100 + 8*mib
+			if min := filesystemMinSize[p.FS]; size < min {
+				size = min
+			}
+		}
+		size = (size + mib - 1) / mib * mib
+
+		p.Start = fmt.Sprintf("%dMiB", offset/mib)
+		p.End = fmt.Sprintf("%dMiB", (offset+size)/mib)
+		log.Printf("Partition %s sized to %s\n", p.Name, units.BytesSize(float64(size)))
+		offset += size
+	}
+
+	/* And room for the backup gpt */
+	if offset+mib > i.size {
+		return fmt.Errorf("Auto sized image of %s exceeds the maximum size %s",
+			units.BytesSize(float64(offset+mib)), i.MaxSize)
+	}
+
+	return nil
+}
+
+/* Cut an auto sized image down to its partitions, and move the backup gpt
+ * to the new end */
+func (i ImagePartitionAction) PostMachine(context DebosContext) error {
+	if i.ImageSize != "auto" {
+		return nil
+	}
+
+	var end int64
+	for _, p := range i.Partitions {
+		offset, size, err := imagePartitionRange(i.ImageName, p.number)
+		if err != nil {
+			return err
+		}
+		if offset+size > end {
+			end = offset + size
+		}
+	}
+
+	const mib = 1 << 20
+	size := (end+mib-1)/mib*mib + mib
+	log.Printf("Image sized to %s\n", units.BytesSize(float64(size)))
+	err := os.Truncate(i.ImageName, size)
+	if err != nil {
+		return fmt.Errorf("Couldn't resize image: %v", err)
+	}
+
+	if i.PartitionType == "gpt" {
+		return Command{}.Run("sgdisk", "sgdisk", "-e", i.ImageName)
+	}
+	return nil
+}
+
+/* Partitions are numbered in list order unless numbered explicitly, which
+ * decouples the numbers from the order on disk. parted always picks the
+ * lowest free number, so the numbers have to be 1 up to the number of
+ * partitions. Cloned tables and sfdisk scripts bring their own numbers */
+func (i *ImagePartitionAction) numberPartitions() error {
+	explicit := 0
+	for _, p := range i.Partitions {
+		if p.Number != 0 {
+			explicit++
+		}
+	}
+	if explicit != 0 && explicit != len(i.Partitions) {
+		return errors.New("Either all or no partitions need a number")
+	}
+
+	used := make(map[int]string)
+	for idx, _ := range i.Partitions {
+		p := &i.Partitions[idx]
+		p.number = idx + 1
+		if explicit != 0 {
+			p.number = p.Number
+		}
+
+		parted := i.Clone == "" && i.Sfdisk == ""
+		if p.number < 1 || (parted && p.number > len(i.Partitions)) {
+			return fmt.Errorf("Partition %s: number %d isn't between 1 and %d",
+				p.Name, p.number, len(i.Partitions))
+		}
+		if other, ok := used[p.number]; ok {
+			return fmt.Errorf("Partitions %s and %s have the same number %d", other, p.Name, p.number)
+		}
+		used[p.number] = p.Name
+	}
+
+	/* Only primary partitions are created on msdos */
+	if i.Clone == "" && i.Sfdisk == "" && i.PartitionType == "msdos" && len(i.Partitions) > 4 {
+		return fmt.Errorf("msdos supports at most 4 partitions, got %d", len(i.Partitions))
+	}
+
+	return nil
+}
+
+/* Parents have to be mounted before what's mounted inside them, whatever
+ * order the recipe lists them in; the order is kept otherwise */
+func (i *ImagePartitionAction) sortMountpoints() {
+	depth := func(m Mountpoint) int {
+		p := path.Clean(m.Mountpoint)
+		if p == "/" {
+			return 0
+		}
+		return strings.Count(p, "/")
+	}
+	sort.SliceStable(i.Mountpoints, func(a, b int) bool {
+		return depth(i.Mountpoints[a]) < depth(i.Mountpoints[b])
+	})
+}
+
+/* Mountpoint a path in the image ends up on */
+func (i ImagePartitionAction) mountpointOf(p string) *Mountpoint {
+	var best *Mountpoint
+	for idx, _ := range i.Mountpoints {
+		m := &i.Mountpoints[idx]
+		below := m.Mountpoint == "/" || p == m.Mountpoint || strings.HasPrefix(p, m.Mountpoint+"/")
+		if below && (best == nil || len(m.Mountpoint) > len(best.Mountpoint)) {
+			best = m
+		}
+	}
+	return best
+}
+
+/* Heuristics for common mistakes in the filesystem choices */
+func (i *ImagePartitionAction) checkFilesystems(context *DebosContext) error {
+	for _, p := range i.Partitions {
+		for _, f := range p.Flags {
+			/* On gpt parted uses boot as an alias for esp */
+			esp := f == "esp" || (f == "boot" && i.PartitionType == "gpt")
+			if esp && p.FS != "fat32" && p.FS != "vfat" {
+				err := context.Warn("Partition %s is an EFI system partition but uses %s instead of fat32",
+					p.Name, p.FS)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, m := range i.Mountpoints {
+		if m.Mountpoint == "/" && !rootFilesystems[m.part.FS] {
+			err := context.Warn("Root filesystem %s may need extra modules to be mounted", m.part.FS)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *ImagePartitionAction) Verify(context *DebosContext) error {
+	switch i.SectorSize {
+	case 0:
+		i.SectorSize = 512
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("Unsupported sector size %d", i.SectorSize)
+	}
+	/* The fakemachine exposes the image as a virtio disk with 512 byte
+	 * logical sectors */
+	if i.SectorSize != 512 && (fakemachine.InMachine() || fakemachine.Supported()) {
+		return fmt.Errorf("Sector size %d needs building without fakemachine", i.SectorSize)
+	}
+
+	if i.FormatJobs < 0 {
+		return fmt.Errorf("Invalid number of format jobs %d", i.FormatJobs)
+	}
+	if i.FormatJobs == 0 {
+		i.FormatJobs = runtime.NumCPU()
+	}
+
+	if i.UUIDTimeout < 0 {
+		return fmt.Errorf("Invalid uuid timeout %d", i.UUIDTimeout)
+	}
+	if i.UUIDTimeout == 0 {
+		i.UUIDTimeout = 5
+	}
+
+	err := i.numberPartitions()
+	if err != nil {
+		return err
+	}
+
+	/* The checks below need the label type, which may come from these */
+	if i.Clone != "" && i.Sfdisk != "" {
+		return errors.New("Only one of clone and sfdisk can be used")
+	}
+
+	if i.Sfdisk != "" {
+		err := i.readSfdiskScript(CleanPathAt(i.Sfdisk, context.recipeDir))
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.Clone != "" {
+		count, err := i.readCloneTable(CleanPathAt(i.Clone, context.recipeDir))
+		if err != nil {
+			return err
+		}
+		if count != len(i.Partitions) {
+			return fmt.Errorf("%s has %d partitions but %d are declared",
+				i.Clone, count, len(i.Partitions))
+		}
+	}
+
+	for idx, _ := range i.Partitions {
+		p := &i.Partitions[idx]
+		if p.Name == "" {
+			return fmt.Errorf("Partition without a name")
+		}
+		if i.PartitionType == "gpt" && gptPartitionName(p.Name) != p.Name {
+			err := context.Warn("Partition name %s gets labeled %s in the GPT", p.Name,
+				gptPartitionName(p.Name))
+			if err != nil {
+				return err
+			}
+		}
+		/* Geometry of cloned tables comes from the source or script */
+		if i.ImageSize == "auto" && (p.Start == "") != (p.End == "") {
+			return fmt.Errorf("Partition %s needs both start and end for a fixed size, or neither", p.Name)
+		}
+		if i.Clone == "" && i.Sfdisk == "" && i.ImageSize != "auto" && !i.keepTable() {
+			if p.Start == "" {
+				return fmt.Errorf("Partition %s missing start", p.Name)
+			}
+			if p.End == "" {
+				return fmt.Errorf("Partition %s missing end", p.Name)
+			}
+			if err := i.checkAlignment(p.Start); err != nil {
+				return fmt.Errorf("Partition %s start: %v", p.Name, err)
+			}
+			if err := i.checkAlignment(p.End); err != nil {
+				return fmt.Errorf("Partition %s end: %v", p.Name, err)
+			}
+		}
+
+		if p.ESP {
+			if err := i.setupESP(p); err != nil {
+				return err
+			}
+		}
+		if built, err := context.StringValue("filesystem." + p.Source); p.Source != "" && err == nil {
+			/* Built by a filesystem action before this one runs */
+			p.Source = built
+			p.built = true
+		} else if p.Source != "" {
+			p.Source = CleanPathAt(p.Source, context.recipeDir)
+			if _, err := os.Stat(p.Source); err != nil {
+				return fmt.Errorf("Partition %s: %v", p.Name, err)
+			}
+		} else if p.FS == "" {
+			return fmt.Errorf("Partition %s missing fs type", p.Name)
+		}
+		if p.PartedFS != "" && p.PartedFS != "none" && !partedFilesystems[p.PartedFS] {
+			return fmt.Errorf("Partition %s: parted doesn't know fs type %s", p.Name, p.PartedFS)
+		}
+
+		if (p.HashSeed != "" || p.Inodes != 0) && !isExtFS(p.FS) {
+			return fmt.Errorf("Partition %s: hashseed and inodes only apply to ext filesystems", p.Name)
+		}
+		if p.UUID != "" {
+			if !uuidRegexp.MatchString(p.UUID) {
+				return fmt.Errorf("Partition %s: invalid uuid %s", p.Name, p.UUID)
+			}
+			if i.PartitionType != "gpt" {
+				return fmt.Errorf("Partition %s: partition uuids can only be set on gpt", p.Name)
+			}
+			for _, f := range p.SgdiskFlags {
+				if strings.HasPrefix(f, "partition-guid=") {
+					return fmt.Errorf("Partition %s: only one of uuid and the partition-guid flag can be used", p.Name)
+				}
+			}
+			p.UUID = strings.ToLower(p.UUID)
+			p.partUUID = p.UUID
+			for _, other := range i.Partitions[:idx] {
+				if strings.EqualFold(other.UUID, p.UUID) {
+					return fmt.Errorf("Partitions %s and %s have the same uuid", other.Name, p.Name)
+				}
+			}
+		}
+		if p.HashSeed != "" && !uuidRegexp.MatchString(p.HashSeed) {
+			return fmt.Errorf("Partition %s: hashseed %s isn't a UUID", p.Name, p.HashSeed)
+		}
+		if p.FSUUID != "" && isExtFS(p.FS) && !uuidRegexp.MatchString(p.FSUUID) {
+			return fmt.Errorf("Partition %s: fsuuid %s isn't a UUID", p.Name, p.FSUUID)
+		}
+		if p.Inodes < 0 {
+			return fmt.Errorf("Partition %s: invalid inode count %d", p.Name, p.Inodes)
+		}
+
+		if (p.FatSize != 0 || p.FatCluster != 0) && p.FS != "fat32" {
+			return fmt.Errorf("Partition %s: fatsize and fatcluster only apply to fat32", p.Name)
+		}
+		if _, ok := fatClusters[p.FatSize]; p.FatSize != 0 && !ok {
+			return fmt.Errorf("Partition %s: invalid fat size %d", p.Name, p.FatSize)
+		}
+		if p.FatCluster < 0 || p.FatCluster > 128 || p.FatCluster&(p.FatCluster-1) != 0 {
+			return fmt.Errorf("Partition %s: sectors per cluster %d isn't a power of two up to 128",
+				p.Name, p.FatCluster)
+		}
+
+		if len(p.Attributes) > 0 && i.PartitionType != "gpt" {
+			return fmt.Errorf("Partition %s: attributes are only supported on gpt", p.Name)
+		}
+		for _, bit := range p.Attributes {
+			if bit < 0 || bit > 63 {
+				return fmt.Errorf("Partition %s: invalid attribute bit %d", p.Name, bit)
+			}
+		}
+
+		if len(p.SgdiskFlags) > 0 && i.PartitionType != "gpt" {
+			return fmt.Errorf("Partition %s: sgdisk flags are only supported on gpt", p.Name)
+		}
+		for _, f := range p.SgdiskFlags {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 || !sgdiskOptions[kv[0]] {
+				return fmt.Errorf("Partition %s: unsupported sgdisk flag %s", p.Name, f)
+			}
+		}
+	}
+
+	/* Mounted in this order and unmounted in reverse */
+	i.sortMountpoints()
+	for idx, _ := range i.Mountpoints {
+		m := &i.Mountpoints[idx]
+		for pidx, _ := range i.Partitions {
+			p := &i.Partitions[pidx]
+			if m.Partition == p.Name {
+				m.part = p
+				break
+			}
+		}
+		if m.part == nil {
+			return fmt.Errorf("Couldn't fount partition for %s", m.Mountpoint)
+		}
+		if m.part.Source != "" && m.part.FS == "" {
+			return fmt.Errorf("Partition %s needs the fs type of its source to be mounted", m.part.Name)
+		}
+		switch m.MountBy {
+		case "", "uuid":
+		case "partuuid":
+			if i.PartitionType != "gpt" {
+				return fmt.Errorf("Mountpoint %s: mounting by partuuid needs a gpt table", m.Mountpoint)
+			}
+		default:
+			return fmt.Errorf("Mountpoint %s: unknown mountby %s", m.Mountpoint, m.MountBy)
+		}
+	}
+
+	for _, o := range i.Overlays {
+		if !path.IsAbs(o.Mountpoint) || !path.IsAbs(o.Upper) {
+			return fmt.Errorf("Overlay %s: mountpoint and upper have to be absolute paths", o.Mountpoint)
+		}
+		if !overlayAllowed(path.Clean(o.Mountpoint)) {
+			return fmt.Errorf("Overlay %s: overlays are only mounted once booted, too late for it",
+				o.Mountpoint)
+		}
+		if o.Upper == o.Mountpoint || strings.HasPrefix(o.Upper, o.Mountpoint+"/") {
+			return fmt.Errorf("Overlay %s: upper can't be inside the overlay", o.Mountpoint)
+		}
+		if m := i.mountpointOf(o.Upper); m == nil || isReadOnlyFS(m.part.FS) {
+			return fmt.Errorf("Overlay %s: upper %s isn't on a writable partition", o.Mountpoint, o.Upper)
+		}
+	}
+
+	if i.Wipe && !context.allowWipe {
+		return errors.New("Wiping the image needs --allow-wipe")
+	}
+
+	if i.ExpandGPT {
+		if i.PartitionType != "gpt" {
+			return errors.New("expandgpt is only supported on gpt")
+		}
+		root := false
+		for _, m := range i.Mountpoints {
+			root = root || m.Mountpoint == "/"
+		}
+		if !root {
+			return errors.New("expandgpt needs a / mountpoint for its marker")
+		}
+	}
+
+	switch i.Backend {
+	case "", "parted":
+		for _, p := range i.Partitions {
+			if p.Type != "" || len(p.Repart) > 0 {
+				return fmt.Errorf("Partition %s: type and repart need the repart backend", p.Name)
+			}
+		}
+	case "repart":
+		if i.PartitionType != "gpt" {
+			return errors.New("The repart backend only supports gpt")
+		}
+		if i.Clone != "" || i.Sfdisk != "" {
+			return errors.New("The repart backend can't be used with clone or sfdisk")
+		}
+		for _, p := range i.Partitions {
+			if p.Number != 0 {
+				return fmt.Errorf("Partition %s: repart numbers partitions in order", p.Name)
+			}
+			if _, ok := i.parseOffset(p.Start, 0); !ok || strings.HasSuffix(p.Start, "%") {
+				return fmt.Errorf("Partition %s: repart needs a fixed start", p.Name)
+			}
+			if _, ok := i.parseOffset(p.End, 0); (!ok || strings.HasSuffix(p.End, "%")) && p.End != "100%" {
+				return fmt.Errorf("Partition %s: repart needs a fixed end or 100%%", p.Name)
+			}
+			for _, r := range p.Repart {
+				if !strings.Contains(r, "=") {
+					return fmt.Errorf("Partition %s: invalid repart setting %s", p.Name, r)
+				}
+				if repartContentSettings[strings.SplitN(r, "=", 2)[0]] {
+					return fmt.Errorf("Partition %s: %s would be undone by formatting the partition",
+						p.Name, r)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown partitioning backend %s", i.Backend)
+	}
+
+	err = i.checkFilesystems(context)
+	if err != nil {
+		return err
+	}
+
+	if i.keepTable() {
+		err = i.checkKeepTable()
+		if err != nil {
+			return err
+		}
+	}
+
+	imageSize := i.ImageSize
+	if imageSize == "auto" {
+		err = i.checkAutoSize()
+		if err != nil {
+			return err
+		}
+		imageSize = i.MaxSize
+	}
+
+	size, err := units.FromHumanSize(imageSize)
+	if err != nil {
+		return fmt.Errorf("Failed to parse image size: %s", imageSize)
+	}
+
+	if size%int64(i.SectorSize) != 0 {
+		return fmt.Errorf("Image size %s isn't a multiple of the %d byte sector size",
+			i.ImageSize, i.SectorSize)
 	}
 
 	i.size = size
+
+	if i.Clone == "" && i.Sfdisk == "" && i.ImageSize != "auto" && !i.keepTable() {
+		err = i.checkSizes()
+		if err != nil {
+			return err
+		}
+		err = i.checkFat()
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Let later actions find the image and its partitions */
+	context.imageFile = i.ImageName
+	context.imageLayout = i
+	context.imagePartitions = make(map[string]int)
+	for _, p := range i.Partitions {
+		context.imagePartitions[p.Name] = p.number
+	}
+
 	return nil
 }
+
+/* Byte range of a partition in an image file (or device), using the
+ * partition table rather than the kernel's view so no loop device is needed */
+func imagePartitionRange(image string, number int) (offset, size int64, err error) {
+	out, err := exec.Command("sfdisk", "--json", image).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Couldn't read partition table of %s: %v", image, err)
+	}
+
+	var table struct {
+		PartitionTable struct {
+			SectorSize int64 `json:"sectorsize"`
+			Partitions []struct {
+				Node  string `json:"node"`
+				Start int64  `json:"start"`
+				Size  int64  `json:"size"`
+			} `json:"partitions"`
+		} `json:"partitiontable"`
+	}
+	err = json.Unmarshal(out, &table)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Couldn't parse partition table of %s: %v", image, err)
+	}
+
+	sectorSize := table.PartitionTable.SectorSize
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+
+	/* Empty slots aren't listed, so go by the number the node ends in */
+	suffix := fmt.Sprintf("%d", number)
+	for _, p := range table.PartitionTable.Partitions {
+		prefix := strings.TrimSuffix(p.Node, suffix)
+		if prefix == p.Node || prefix == "" || (prefix[len(prefix)-1] >= '0' && prefix[len(prefix)-1] <= '9') {
+			continue
+		}
+		return p.Start * sectorSize, p.Size * sectorSize, nil
+	}
+
+	return 0, 0, fmt.Errorf("No partition %d in %s", number, image)
+}
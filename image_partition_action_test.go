@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStagingReadOnly(t *testing.T) {
+	p := Partition{Name: "root", FS: "ext4", FSUUID: "1234"}
+	i := ImagePartitionAction{
+		Partitions:  []Partition{p},
+		Mountpoints: []Mountpoint{{Mountpoint: "/", Partition: "root", Options: []string{"ro"}}},
+	}
+	i.Mountpoints[0].part = &i.Partitions[0]
+
+	/* ro in fstab doesn't affect staging */
+	flags, _ := i.Partitions[0].stagingMountOptions()
+	if flags&syscall.MS_RDONLY != 0 {
+		t.Errorf("Staging mount is read-only because of the fstab options")
+	}
+
+	var context DebosContext
+	err := i.generateFSTab(&context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(context.imageFSTab.String(), "defaults,ro") {
+		t.Errorf("fstab misses ro: %s", context.imageFSTab.String())
+	}
+
+	/* staging_ro only affects staging */
+	i.Mountpoints[0].Options = nil
+	i.Partitions[0].StagingRO = true
+	i.Partitions[0].StagingOptions = []string{"noatime"}
+	flags, data := i.Partitions[0].stagingMountOptions()
+	if flags&syscall.MS_RDONLY == 0 || flags&syscall.MS_NOATIME == 0 {
+		t.Errorf("Staging mount flags %x miss ro or noatime", flags)
+	}
+	if data != "" {
+		t.Errorf("Unexpected mount data %s", data)
+	}
+
+	err = i.generateFSTab(&context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(context.imageFSTab.String(), "ro") {
+		t.Errorf("staging_ro ended up in fstab: %s", context.imageFSTab.String())
+	}
+}
+
+/* Run with GOARCH=386 or arm to check large images on 32-bit hosts */
+func TestLargeImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var size int64 = 4 << 30
+	image := path.Join(dir, "large.img")
+	err = createImageFile(image, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != size {
+		t.Errorf("Image is %d bytes instead of %d", st.Size(), size)
+	}
+
+	i := ImagePartitionAction{
+		ImageSize:  "4GiB",
+		SectorSize: 512,
+		Partitions: []Partition{
+			{Name: "esp", FS: "fat32", Start: "1MiB", End: "3GiB"},
+			{Name: "root", FS: "ext4", Start: "3GiB", End: "100%"},
+		},
+		size: size,
+	}
+	for offset, expected := range map[string]int64{
+		"3GiB":     3 << 30,
+		"75%":      3 << 30,
+		"100%":     size,
+		"8388607s": 8388607 * 512,
+	} {
+		n, ok := i.parseOffset(offset, size)
+		if !ok || n != expected {
+			t.Errorf("%s parsed as %d instead of %d", offset, n, expected)
+		}
+	}
+	err = i.checkSizes()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGptPartitionName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"root":      "root",
+		`my "root"`: "my root",
+		"a-partition-name-way-past-36-characters": "a-partition-name-way-past-36-charact",
+		/* Outside the BMP each takes two code units */
+		strings.Repeat("\U0001F600", 20): strings.Repeat("\U0001F600", 18),
+	} {
+		label := gptPartitionName(name)
+		if label != expected {
+			t.Errorf("%q labeled %q instead of %q", name, label, expected)
+		}
+	}
+}
+
+func TestCheckFSTab(t *testing.T) {
+	i := ImagePartitionAction{
+		Partitions: []Partition{
+			{Name: "root", FS: "ext4", FSUUID: "1234"},
+			{Name: "home", FS: "ext4", FSUUID: "1234"},
+			{Name: "data", FS: "ext4"},
+		},
+		Mountpoints: []Mountpoint{
+			{Mountpoint: "/home", Partition: "root"},
+			{Mountpoint: "/home", Partition: "home"},
+			{Mountpoint: "/data", Partition: "data"},
+		},
+	}
+	for idx := range i.Mountpoints {
+		i.Mountpoints[idx].part = &i.Partitions[idx]
+	}
+
+	err := i.checkFSTab(&DebosContext{strict: true})
+	if err == nil {
+		t.Fatalf("Broken fstab accepted")
+	}
+	for _, problem := range []string{"/home is mounted more than once",
+		"partitions root and home share uuid 1234", "no uuid captured for partition data"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Problem %q not reported: %v", problem, err)
+		}
+	}
+
+	i.Partitions[1].FSUUID = "5678"
+	i.Partitions[2].FSUUID = "9abc"
+	i.Mountpoints[0].Mountpoint = "/"
+	err = i.checkFSTab(&DebosContext{strict: true})
+	if err != nil {
+		t.Errorf("Valid fstab rejected: %v", err)
+	}
+}
+
+func TestMountByPartUUID(t *testing.T) {
+	i := ImagePartitionAction{
+		Partitions: []Partition{{Name: "root", FS: "ext4", FSUUID: "1234",
+			partUUID: "6f2a1d2e-3c47-4b7e-9a55-0d3c1b2e4f60"}},
+		Mountpoints: []Mountpoint{{Mountpoint: "/", Partition: "root", MountBy: "partuuid"}},
+	}
+	i.Mountpoints[0].part = &i.Partitions[0]
+
+	var context DebosContext
+	err := i.generateFSTab(&context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(context.imageFSTab.String(), "PARTUUID=6f2a1d2e-3c47-4b7e-9a55-0d3c1b2e4f60\t/") {
+		t.Errorf("root isn't mounted by partuuid: %s", context.imageFSTab.String())
+	}
+
+	err = i.generateKernelRoot(&context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.imageKernelRoot != "root=PARTUUID=6f2a1d2e-3c47-4b7e-9a55-0d3c1b2e4f60" {
+		t.Errorf("Unexpected kernel root %s", context.imageKernelRoot)
+	}
+}
+
+func TestSortMountpoints(t *testing.T) {
+	i := ImagePartitionAction{
+		Mountpoints: []Mountpoint{{Mountpoint: "/boot/efi"}, {Mountpoint: "/home"},
+			{Mountpoint: "/boot"}, {Mountpoint: "/"}},
+	}
+	i.sortMountpoints()
+
+	var order []string
+	for _, m := range i.Mountpoints {
+		order = append(order, m.Mountpoint)
+	}
+	if strings.Join(order, " ") != "/ /home /boot /boot/efi" {
+		t.Errorf("Unexpected mount order %v", order)
+	}
+}
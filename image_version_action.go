@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/debos/fakemachine"
+)
+
+/* Records which build an image is: /etc/image-version gets the version and
+ * the git commit of the recipe checkout in os-release syntax, and
+ * /usr/share/doc/image/changelog the git log up to it, or a changelog file
+ * from the recipe. Outside of a git checkout, e.g. on CI exporting the tree,
+ * the commit has to be given, typically as a template variable */
+type ImageVersionAction struct {
+	BaseAction `yaml:",inline"`
+	Version    string
+	Commit     string // Instead of the one checked out
+	Changelog  string // File relative to the recipe, instead of the git log
+	Entries    int    // Commits in the generated changelog
+	gitdir     string
+}
+
+func newImageVersionAction() *ImageVersionAction {
+	return &ImageVersionAction{Entries: 50}
+}
+
+/* git in the fakemachine runs as root on a checkout owned by whoever runs
+ * debos, which it refuses unless told otherwise */
+func gitCommand(dir string, args ...string) (string, error) {
+	cmdline := append([]string{"-c", "safe.directory=*", "-C", dir}, args...)
+	out, err := exec.Command("git", cmdline...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (iv *ImageVersionAction) Verify(context *DebosContext) error {
+	if iv.Entries < 0 {
+		return fmt.Errorf("Invalid number of changelog entries %d", iv.Entries)
+	}
+
+	if iv.Changelog != "" {
+		if _, err := os.Stat(CleanPathAt(iv.Changelog, context.recipeDir)); err != nil {
+			return fmt.Errorf("Couldn't find changelog: %v", err)
+		}
+	}
+
+	top, err := gitCommand(context.recipeDir, "rev-parse", "--show-toplevel")
+	if err == nil {
+		iv.gitdir = top
+	} else if iv.Commit == "" {
+		return errors.New("Recipe isn't in a git checkout, the commit has to be given")
+	}
+
+	return nil
+}
+
+func (iv *ImageVersionAction) PreMachine(context *DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	/* The recipe directory alone may not hold the repository */
+	if iv.gitdir != "" {
+		m.AddVolume(iv.gitdir)
+	}
+	return nil
+}
+
+func (iv *ImageVersionAction) Run(context *DebosContext) error {
+	iv.LogStart()
+
+	fields := map[string]string{"BUILD_DATE": sbomTimestamp()}
+	if iv.Version != "" {
+		fields["VERSION"] = iv.Version
+	}
+
+	commit := iv.Commit
+	var changelog string
+	if iv.gitdir != "" {
+		head, err := gitCommand(iv.gitdir, "rev-parse", "HEAD")
+		if err != nil {
+			return fmt.Errorf("Couldn't get the git commit: %v", err)
+		}
+		if commit == "" {
+			commit = head
+			fields["GIT_DESCRIBE"], _ = gitCommand(iv.gitdir, "describe", "--always", "--dirty")
+		}
+		if iv.Changelog == "" && iv.Entries > 0 {
+			changelog, err = gitCommand(iv.gitdir, "log", "--date=short",
+				"--format=%h %ad %s", "-n", fmt.Sprintf("%d", iv.Entries), commit)
+			if err != nil {
+				return fmt.Errorf("Couldn't get the git log: %v", err)
+			}
+		}
+	}
+	fields["GIT_COMMIT"] = commit
+
+	if iv.Changelog != "" {
+		content, err := ioutil.ReadFile(CleanPathAt(iv.Changelog, context.recipeDir))
+		if err != nil {
+			return fmt.Errorf("Couldn't read changelog: %v", err)
+		}
+		changelog = strings.TrimSpace(string(content))
+	}
+
+	content := strings.Join(osReleaseLines(fields), "\n") + "\n"
+	err := ioutil.WriteFile(path.Join(context.rootdir, "etc/image-version"), []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write image version: %v", err)
+	}
+
+	if changelog == "" {
+		return nil
+	}
+
+	docdir := path.Join(context.rootdir, "usr/share/doc/image")
+	err = os.MkdirAll(docdir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(docdir, "changelog"), []byte(changelog+"\n"), 0644)
+}
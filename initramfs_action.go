@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* (Re)generates the initramfs for the kernel in the target with the given
+ * modules forced in. Should run after fstab/crypttab are set up, as the
+ * generators look at those to decide what is needed */
+type InitramfsAction struct {
+	BaseAction `yaml:",inline"`
+	Generator  string
+	Kernel     string // Kernel version, defaults to the newest installed
+	Modules    []string
+}
+
+func newInitramfsAction() *InitramfsAction {
+	return &InitramfsAction{Generator: "initramfs-tools"}
+}
+
+func (ia *InitramfsAction) Verify(context *DebosContext) error {
+	switch ia.Generator {
+	case "initramfs-tools", "dracut":
+		return nil
+	}
+	return fmt.Errorf("Unknown initramfs generator %s", ia.Generator)
+}
+
+func (ia *InitramfsAction) kernelVersion(context *DebosContext) (string, error) {
+	if ia.Kernel != "" {
+		return ia.Kernel, nil
+	}
+	return newestKernelVersion(context.rootdir)
+}
+
+/* Newest kernel installed in the rootfs, going by its modules */
+func newestKernelVersion(rootdir string) (string, error) {
+	dirs, err := ioutil.ReadDir(path.Join(rootdir, "lib/modules"))
+	if err != nil {
+		return "", fmt.Errorf("No kernel modules found: %v", err)
+	}
+
+	var versions []string
+	for _, d := range dirs {
+		if d.IsDir() {
+			versions = append(versions, d.Name())
+		}
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("No kernel installed")
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+
+	return versions[len(versions)-1], nil
+}
+
+/* Compare versions like 6.1.0-10-amd64 piecewise, numbers by their value
+ * and anything else as text, so 6.1.0-10 comes after 6.1.0-9 */
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		pa, ra := versionPiece(a)
+		pb, rb := versionPiece(b)
+		na, errA := strconv.Atoi(pa)
+		nb, errB := strconv.Atoi(pb)
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && pa != pb:
+			return strings.Compare(pa, pb)
+		}
+		a, b = ra, rb
+	}
+	return strings.Compare(a, b)
+}
+
+/* The leading run of digits or of anything else, and the rest */
+func versionPiece(v string) (string, string) {
+	digit := func(c byte) bool { return c >= '0' && c <= '9' }
+	n := 1
+	for n < len(v) && digit(v[n]) == digit(v[0]) {
+		n++
+	}
+	return v[:n], v[n:]
+}
+
+/* Add modules to a config file, one per line, skipping those already in */
+func appendModules(file string, modules []string) error {
+	current, _ := ioutil.ReadFile(file)
+	existing := make(map[string]bool)
+	for _, l := range strings.Split(string(current), "\n") {
+		existing[strings.TrimSpace(l)] = true
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, m := range modules {
+		if existing[m] {
+			continue
+		}
+		_, err = f.WriteString(m + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ia *InitramfsAction) Run(context *DebosContext) error {
+	ia.LogStart()
+
+	version, err := ia.kernelVersion(context)
+	if err != nil {
+		return err
+	}
+	initrd := fmt.Sprintf("/boot/initrd.img-%s", version)
+
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+
+	switch ia.Generator {
+	case "initramfs-tools":
+		err = appendModules(path.Join(context.rootdir, "etc/initramfs-tools/modules"), ia.Modules)
+		if err != nil {
+			return fmt.Errorf("Couldn't add initramfs modules: %v", err)
+		}
+
+		mode := "-c"
+		if _, err := os.Stat(path.Join(context.rootdir, initrd)); err == nil {
+			mode = "-u"
+		}
+		err = c.Run("update-initramfs", "update-initramfs", mode, "-k", version)
+	case "dracut":
+		confdir := path.Join(context.rootdir, "etc/dracut.conf.d")
+		err = os.MkdirAll(confdir, 0755)
+		if err != nil {
+			return err
+		}
+
+		if len(ia.Modules) > 0 {
+			conf := fmt.Sprintf("force_drivers+=\" %s \"\n", strings.Join(ia.Modules, " "))
+			err = ioutil.WriteFile(path.Join(confdir, "debos.conf"), []byte(conf), 0644)
+			if err != nil {
+				return fmt.Errorf("Couldn't write dracut configuration: %v", err)
+			}
+		}
+
+		err = c.Run("dracut", "dracut", "--force", initrd, version)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Generated %s\n", initrd)
+	context.SetValue("initrd", initrd)
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNewestKernelVersion(t *testing.T) {
+	rootdir, err := ioutil.TempDir("", "debos-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootdir)
+
+	for _, v := range []string{"6.1.0-9-amd64", "6.1.0-10-amd64", "5.10.0-28-amd64"} {
+		err = os.MkdirAll(path.Join(rootdir, "lib/modules", v), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, err := newestKernelVersion(rootdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "6.1.0-10-amd64" {
+		t.Errorf("Newest kernel is %s instead of 6.1.0-10-amd64", version)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+/* Writes /etc/default/keyboard as keyboard-configuration would */
+type KeyboardAction struct {
+	BaseAction `yaml:",inline"`
+	Model      string
+	Layout     string
+	Variant    string
+	Options    string
+}
+
+func newKeyboardAction() *KeyboardAction {
+	return &KeyboardAction{Model: "pc105"}
+}
+
+func (kb *KeyboardAction) Verify(context *DebosContext) error {
+	if kb.Layout == "" {
+		return errors.New("No keyboard layout given")
+	}
+	return nil
+}
+
+func (kb *KeyboardAction) Run(context *DebosContext) error {
+	kb.LogStart()
+
+	content := fmt.Sprintf(`XKBMODEL="%s"
+XKBLAYOUT="%s"
+XKBVARIANT="%s"
+XKBOPTIONS="%s"
+BACKSPACE="guess"
+`, kb.Model, kb.Layout, kb.Variant, kb.Options)
+
+	err := os.MkdirAll(path.Join(context.rootdir, "etc/default"), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(context.rootdir, "etc/default/keyboard"),
+		[]byte(content), 0644)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* Checks a recipe without building anything: it is decoded strictly, so keys
+ * the actions don't know are reported rather than ignored, and the actions
+ * get verified with warnings counting as issues, skipping the checks that
+ * have to run something. All issues found are returned, not just the first */
+func lintRecipe(context *DebosContext, name string, recipe []byte) []string {
+	var issues []string
+
+	t := template.New(name)
+	t.Funcs(templateFuncs(context, context.templateExec))
+	_, err := t.Parse(string(recipe))
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	data := new(bytes.Buffer)
+	err = t.Execute(data, context.templateVars)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	r, err := parseRecipe(data.Bytes(), true)
+	if terr, ok := err.(*yaml.TypeError); ok {
+		issues = append(issues, terr.Errors...)
+	} else if err != nil {
+		return []string{err.Error()}
+	}
+
+	/* Unknown actions are reported already */
+	var actions []YamlAction
+	for _, a := range r.Actions {
+		if a.Action != nil {
+			actions = append(actions, a)
+		}
+	}
+
+	r.Actions, err = sortActions(actions)
+	if err != nil {
+		return append(issues, err.Error())
+	}
+
+	context.Architecture = r.Architecture
+	if context.Architecture == "" {
+		issues = append(issues, "No architecture given")
+	}
+
+	for _, s := range r.Secrets {
+		if _, err := s.resolve(context.recipeDir); err != nil {
+			issues = append(issues, fmt.Sprintf("Secret: %v", err))
+		}
+	}
+
+	context.strict = true
+	context.linting = true
+	for _, a := range r.Actions {
+		if err := checkDeferredValues(a.Action); err != nil {
+			issues = append(issues, fmt.Sprintf("%s: %v", a, err))
+		}
+		if err := a.Verify(context); err != nil {
+			issues = append(issues, fmt.Sprintf("%s: %v", a, err))
+		}
+		for _, f := range lintRecipeFiles(a.Action) {
+			if _, err := os.Stat(CleanPathAt(f, context.recipeDir)); err != nil {
+				issues = append(issues, fmt.Sprintf("%s: %v", a, err))
+			}
+		}
+	}
+
+	return issues
+}
+
+/* Files from the recipe directory actions only look at when running */
+func lintRecipeFiles(a Action) []string {
+	var files []string
+	switch a := a.(type) {
+	case *OverlayAction:
+		files = append(files, a.Source)
+	case *FilesystemImageAction:
+		if a.Source != "" {
+			files = append(files, a.Source)
+		}
+	}
+	return files
+}
+
+func lintMain(context *DebosContext, file string) int {
+	recipe, err := readRecipe(file, "")
+	if err != nil {
+		fmt.Printf("Couldn't read recipe: %v\n", err)
+		return 1
+	}
+
+	issues := lintRecipe(context, path.Base(file), recipe)
+	for _, i := range issues {
+		fmt.Printf("%s: %s\n", file, i)
+	}
+	if len(issues) > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/* Generates locales and sets the default without going through debconf */
+type LocaleAction struct {
+	BaseAction `yaml:",inline"`
+	Locales    []string
+	Default    string
+}
+
+var localeRegexp = regexp.MustCompile(`^[a-zA-Z_]+(\.[a-zA-Z0-9-]+)?(@[a-z]+)?$`)
+
+func (l *LocaleAction) Verify(context *DebosContext) error {
+	if len(l.Locales) == 0 {
+		return errors.New("No locales to generate")
+	}
+
+	for _, locale := range l.Locales {
+		if !localeRegexp.MatchString(locale) {
+			return fmt.Errorf("Invalid locale %s", locale)
+		}
+	}
+
+	if l.Default == "" {
+		l.Default = l.Locales[0]
+	} else if !localeRegexp.MatchString(l.Default) && l.Default != "C.UTF-8" {
+		return fmt.Errorf("Invalid default locale %s", l.Default)
+	}
+
+	return nil
+}
+
+/* locale.gen entry, e.g. "en_US.UTF-8 UTF-8" */
+func localeGenEntry(locale string) string {
+	charset := "ISO-8859-1"
+	if idx := strings.Index(locale, "."); idx >= 0 {
+		charset = strings.SplitN(locale[idx+1:], "@", 2)[0]
+	}
+	return fmt.Sprintf("%s %s", locale, charset)
+}
+
+func (l *LocaleAction) Run(context *DebosContext) error {
+	l.LogStart()
+
+	var entries []string
+	for _, locale := range l.Locales {
+		entries = append(entries, localeGenEntry(locale))
+	}
+
+	err := ioutil.WriteFile(path.Join(context.rootdir, "etc/locale.gen"),
+		[]byte(strings.Join(entries, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write locale.gen: %v", err)
+	}
+
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	err = c.Run("locale-gen", "locale-gen")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Join(context.rootdir, "etc/default"), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(context.rootdir, "etc/default/locale"),
+		[]byte(fmt.Sprintf("LANG=%s\n", l.Default)), 0644)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+/* Output and errors of the build both end up in the log file, so they have
+ * to take turns */
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.w.Write(p)
+}
+
+/* With --logfile debos runs itself again without it, with all its output
+ * going to the file as well as to the console. That way the file holds what
+ * the console shows whatever the verbosity, including the output of
+ * fakemachine and everything in the machine */
+func runLogged(file string) int {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("Couldn't open log file: %v", err)
+		return 1
+	}
+	defer f.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("Couldn't find debos executable: %v", err)
+		return 1
+	}
+
+	w := &lockedWriter{w: f}
+	cmd := exec.Command(self, stripOption(os.Args[1:], "--logfile")...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, w)
+	cmd.Stderr = io.MultiWriter(os.Stderr, w)
+
+	err = cmd.Start()
+	if err != nil {
+		log.Printf("Couldn't run debos: %v", err)
+		return 1
+	}
+
+	/* The build gets to clean up and have that logged before this ends */
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for s := range signals {
+			cmd.Process.Signal(s)
+		}
+	}()
+
+	err = cmd.Wait()
+	signal.Stop(signals)
+	if err != nil {
+		return exitStatus(err)
+	}
+
+	return 0
+}
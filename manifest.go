@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* A manifest builds several recipes in order, sharing template variables
+ * and one artifact directory:
+ *
+ *  variables:
+ *    suite: bookworm
+ *  recipes:
+ *    - recipe: bootloader.yaml
+ *    - recipe: rootfs.yaml
+ *      variables:
+ *        image: rootfs.img
+ *
+ * Recipe variables override the shared ones, and -t on the command line
+ * overrides both */
+type Manifest struct {
+	Variables map[string]string
+	Recipes   []ManifestRecipe
+}
+
+type ManifestRecipe struct {
+	Recipe    string // Relative to the manifest
+	Variables map[string]string
+}
+
+type manifestRecipeReport struct {
+	Recipe string          `json:"recipe"`
+	Status string          `json:"status"`
+	Report json.RawMessage `json:"report,omitempty"`
+}
+
+/* Combined --report of a manifest, holding the report of every recipe */
+type manifestReport struct {
+	Version  string                 `json:"version"`
+	Manifest string                 `json:"manifest"`
+	Status   string                 `json:"status"`
+	Recipes  []manifestRecipeReport `json:"recipes"`
+}
+
+func readManifest(file string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = yaml.UnmarshalStrict(content, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Recipes) == 0 {
+		return nil, errors.New("No recipes listed")
+	}
+	for _, r := range m.Recipes {
+		if r.Recipe == "" {
+			return nil, errors.New("Manifest entry without a recipe")
+		}
+	}
+
+	return m, nil
+}
+
+/* Command line for building one recipe of the manifest: the options debos
+ * got, minus those the manifest handles itself */
+func manifestArgs(args []string, file string) []string {
+	args = stripOption(args, "--report")
+
+	var filtered []string
+	for idx := 0; idx < len(args); idx++ {
+		if args[idx] == "manifest" && idx+1 < len(args) && args[idx+1] == file {
+			idx++
+			continue
+		}
+		filtered = append(filtered, args[idx])
+	}
+	return filtered
+}
+
+/* Build the recipes of a manifest one after the other, stopping at the first
+ * failing one. The file is as given on the command line */
+func runManifest(file, artifactdir, reportFile string) int {
+	m, err := readManifest(CleanPath(file))
+	if err != nil {
+		log.Printf("Invalid manifest %s: %v", file, err)
+		return 1
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("Couldn't find debos executable: %v", err)
+		return 1
+	}
+
+	reportdir, err := ioutil.TempDir("", "debos-manifest-")
+	if err != nil {
+		log.Printf("Couldn't create report directory: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(reportdir)
+
+	combined := manifestReport{Version: Version, Manifest: file, Status: "success"}
+	status := 0
+	for idx, r := range m.Recipes {
+		recipe := CleanPathAt(r.Recipe, path.Dir(CleanPath(file)))
+
+		var args []string
+		for _, vars := range []map[string]string{m.Variables, r.Variables} {
+			for k, v := range vars {
+				args = append(args, "-t", fmt.Sprintf("%s:%s", k, v))
+			}
+		}
+		/* Given last so the command line ones win */
+		args = append(args, manifestArgs(os.Args[1:], file)...)
+		args = append(args, "--artifactdir", artifactdir)
+		recipeReport := path.Join(reportdir, fmt.Sprintf("%d.json", idx))
+		if reportFile != "" {
+			args = append(args, "--report", recipeReport)
+		}
+		args = append(args, recipe)
+
+		log.Printf("==== Building %s ====\n", r.Recipe)
+		cmd := exec.Command(self, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+
+		entry := manifestRecipeReport{Recipe: r.Recipe, Status: "success"}
+		if err != nil {
+			log.Printf("Build of %s failed: %v", r.Recipe, err)
+			entry.Status = "failed"
+			combined.Status = "failed"
+			status = exitStatus(err)
+		}
+		if content, err := ioutil.ReadFile(recipeReport); err == nil {
+			entry.Report = content
+		}
+		combined.Recipes = append(combined.Recipes, entry)
+
+		if status != 0 {
+			break
+		}
+	}
+
+	if reportFile != "" {
+		content, err := json.MarshalIndent(combined, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(reportFile, content, 0644)
+		}
+		if err != nil {
+			log.Printf("Couldn't write report %s: %v", reportFile, err)
+		}
+	}
+
+	return status
+}
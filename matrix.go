@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+)
+
+/* Command line without the given option taking a value */
+func stripOption(args []string, option string) []string {
+	var filtered []string
+	for idx := 0; idx < len(args); idx++ {
+		a := args[idx]
+		if a == option {
+			idx++
+			continue
+		}
+		if strings.HasPrefix(a, option+"=") {
+			continue
+		}
+		filtered = append(filtered, a)
+	}
+	return filtered
+}
+
+/* Command line without the arch matrix option, to re-run debos per
+ * architecture */
+func matrixArgs(args []string) []string {
+	return stripOption(args, "--arch-matrix")
+}
+
+/* Exit status to pass on from a debos run as a subprocess */
+func exitStatus(err error) int {
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+/* Build the recipe once for every architecture, sequentially, with the
+ * architecture template variable set and artifacts in a per architecture
+ * subdirectory of the artifact directory */
+func runMatrix(archs []string, artifactdir string) int {
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("Couldn't find debos executable: %v", err)
+		return 1
+	}
+
+	for _, arch := range archs {
+		dir := path.Join(artifactdir, arch)
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			log.Printf("Couldn't create artifact directory %s: %v", dir, err)
+			return 1
+		}
+
+		log.Printf("==== Building for %s ====\n", arch)
+		args := matrixArgs(os.Args[1:])
+		args = append(args, "--artifactdir", dir, "-t", "architecture:"+arch)
+
+		cmd := exec.Command(self, args...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			log.Printf("Build for %s failed: %v", arch, err)
+			return exitStatus(err)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+var mountFlags = map[string]uintptr{
+	"ro":         syscall.MS_RDONLY,
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"sync":       syscall.MS_SYNCHRONOUS,
+	"dirsync":    syscall.MS_DIRSYNC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+/* Split mount(8) style options into mount flags and the filesystem specific
+ * data passed on to the kernel as is */
+func parseMountOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+
+	for _, o := range options {
+		switch {
+		case o == "rw" || o == "defaults":
+		case mountFlags[o] != 0:
+			flags |= mountFlags[o]
+		default:
+			data = append(data, o)
+		}
+	}
+
+	return flags, strings.Join(data, ",")
+}
+
+type busyProcess struct {
+	pid  int
+	comm string
+}
+
+func (p busyProcess) String() string {
+	return fmt.Sprintf("%d (%s)", p.pid, p.comm)
+}
+
+/* Whether a /proc link target is at or below the mountpoint */
+func pathBelow(p, mountpoint string) bool {
+	return p == mountpoint || strings.HasPrefix(p, mountpoint+"/")
+}
+
+/* Find processes with their root, cwd, executable or any open file under the
+ * mountpoint, much like fuser -m */
+func findProcessesUsing(mountpoint string) []busyProcess {
+	var procs []busyProcess
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+
+		procdir := path.Join("/proc", e.Name())
+		links := []string{"root", "cwd", "exe"}
+		fds, _ := ioutil.ReadDir(path.Join(procdir, "fd"))
+		for _, fd := range fds {
+			links = append(links, path.Join("fd", fd.Name()))
+		}
+
+		for _, l := range links {
+			target, err := os.Readlink(path.Join(procdir, l))
+			if err != nil || !pathBelow(target, mountpoint) {
+				continue
+			}
+
+			comm, _ := ioutil.ReadFile(path.Join(procdir, "comm"))
+			procs = append(procs, busyProcess{pid, strings.TrimSpace(string(comm))})
+			break
+		}
+	}
+
+	return procs
+}
+
+/* Indirection so tests can fake busy mounts */
+var unmountSyscall = syscall.Unmount
+
+/* Unmount the mountpoint, reporting processes keeping it busy. With kill set
+ * those processes get killed and the unmount is retried. If it is still busy
+ * after that, fall back to a lazy unmount rather than leaking the mount */
+func unmount(mountpoint string, kill bool) error {
+	err := unmountSyscall(mountpoint, 0)
+	if err != syscall.EBUSY {
+		return err
+	}
+
+	procs := findProcessesUsing(mountpoint)
+	for _, p := range procs {
+		log.Printf("%s kept busy by process %s\n", mountpoint, p)
+	}
+
+	if kill && len(procs) > 0 {
+		for _, p := range procs {
+			log.Printf("Killing %s\n", p)
+			syscall.Kill(p.pid, syscall.SIGKILL)
+		}
+		/* Give the processes a moment to actually go away */
+		for i := 0; i < 10 && len(findProcessesUsing(mountpoint)) > 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		err = unmountSyscall(mountpoint, 0)
+	}
+
+	if err == syscall.EBUSY {
+		log.Printf("Warning: %s busy, falling back to lazy unmount\n", mountpoint)
+		err = unmountSyscall(mountpoint, syscall.MNT_DETACH)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Couldn't unmount %s: %v", mountpoint, err)
+	}
+
+	return nil
+}
+
+/* Mount a tmpfs of the given size on the scratch directory. Failing that the
+ * directory is used as is, so only report whether it worked */
+func mountScratchTmpfs(dir, size string) bool {
+	bytes, err := units.RAMInBytes(size)
+	if err != nil {
+		log.Printf("Invalid scratch tmpfs size %s, not using tmpfs: %v", size, err)
+		return false
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = syscall.Mount("tmpfs", dir, "tmpfs", 0, fmt.Sprintf("size=%d", bytes))
+	}
+	if err != nil {
+		log.Printf("Couldn't mount scratch tmpfs, staging on %s directly: %v", dir, err)
+		return false
+	}
+
+	log.Printf("Staging on a %s tmpfs\n", size)
+	return true
+}
+
+/* A host directory shared with the machine, given as host[:target][:ro] */
+type volume struct {
+	host     string
+	target   string
+	readOnly bool
+}
+
+func parseVolume(spec string) (volume, error) {
+	parts := strings.Split(spec, ":")
+	v := volume{host: parts[0]}
+
+	if len(parts) > 1 && parts[len(parts)-1] == "ro" {
+		v.readOnly = true
+		parts = parts[:len(parts)-1]
+	}
+	switch len(parts) {
+	case 1:
+		v.target = v.host
+	case 2:
+		v.target = parts[1]
+	default:
+		return v, fmt.Errorf("Invalid volume %s", spec)
+	}
+
+	if !path.IsAbs(v.host) || !path.IsAbs(v.target) {
+		return v, fmt.Errorf("Volume %s needs absolute paths", spec)
+	}
+
+	return v, nil
+}
+
+func (v volume) String() string {
+	s := fmt.Sprintf("%s:%s", v.host, v.target)
+	if v.readOnly {
+		s += ":ro"
+	}
+	return s
+}
+
+/* The machine shares volumes at their host path, bind mount them to where
+ * they're wanted */
+func (v volume) mount() error {
+	if v.target == v.host && !v.readOnly {
+		return nil
+	}
+
+	err := os.MkdirAll(v.target, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount(v.host, v.target, "", syscall.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("Couldn't mount volume %s: %v", v, err)
+	}
+
+	if v.readOnly {
+		err = syscall.Mount("", v.target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		if err != nil {
+			return fmt.Errorf("Couldn't make volume %s read-only: %v", v, err)
+		}
+	}
+
+	return nil
+}
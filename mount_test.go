@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestLazyUnmountWhenBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-mount-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(path.Join(dir, "busy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var flags []int
+	unmountSyscall = func(target string, flag int) error {
+		flags = append(flags, flag)
+		if flag&syscall.MNT_DETACH == 0 {
+			return syscall.EBUSY
+		}
+		return nil
+	}
+	defer func() { unmountSyscall = syscall.Unmount }()
+
+	found := false
+	for _, p := range findProcessesUsing(dir) {
+		if p.pid == os.Getpid() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Process holding %s open not found", dir)
+	}
+
+	err = unmount(dir, false)
+	if err != nil {
+		t.Errorf("Unexpected unmount failure: %v", err)
+	}
+
+	if len(flags) != 2 || flags[1] != syscall.MNT_DETACH {
+		t.Errorf("Lazy unmount not attempted, unmount flags: %v", flags)
+	}
+}
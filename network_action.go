@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+type NetworkInterface struct {
+	Name      string
+	Kind      string // "bridge" to create a bridge rather than match a device
+	DHCP      bool
+	Addresses []string // CIDR notation, e.g. 192.168.1.10/24
+	Gateway   string
+	DNS       []string
+	Bridge    string // Bridge to add the interface to
+}
+
+/* Writes the network configuration for either systemd-networkd or ifupdown
+ * and enables the matching service, all offline */
+type NetworkAction struct {
+	BaseAction `yaml:",inline"`
+	Backend    string
+	Interfaces []NetworkInterface
+}
+
+func newNetworkAction() *NetworkAction {
+	return &NetworkAction{Backend: "networkd"}
+}
+
+func (n *NetworkAction) Verify(context *DebosContext) error {
+	switch n.Backend {
+	case "networkd", "ifupdown":
+	default:
+		return fmt.Errorf("Unknown network backend %s", n.Backend)
+	}
+
+	if len(n.Interfaces) == 0 {
+		return errors.New("No interfaces to configure")
+	}
+
+	bridges := make(map[string]bool)
+	for _, i := range n.Interfaces {
+		if i.Kind == "bridge" {
+			bridges[i.Name] = true
+		}
+	}
+
+	for _, i := range n.Interfaces {
+		if i.Name == "" {
+			return errors.New("Interface without a name")
+		}
+		if i.Kind != "" && i.Kind != "bridge" {
+			return fmt.Errorf("Interface %s: unknown kind %s", i.Name, i.Kind)
+		}
+		if i.Bridge != "" {
+			if !bridges[i.Bridge] {
+				return fmt.Errorf("Interface %s: unknown bridge %s", i.Name, i.Bridge)
+			}
+			if i.DHCP || len(i.Addresses) > 0 {
+				return fmt.Errorf("Interface %s is part of bridge %s, configure addresses on the bridge",
+					i.Name, i.Bridge)
+			}
+		}
+		if i.DHCP && len(i.Addresses) > 0 {
+			return fmt.Errorf("Interface %s has both dhcp and static addresses", i.Name)
+		}
+		for _, a := range i.Addresses {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return fmt.Errorf("Interface %s: invalid address %s", i.Name, a)
+			}
+		}
+		for _, ip := range append([]string{i.Gateway}, i.DNS...) {
+			if ip != "" && net.ParseIP(ip) == nil {
+				return fmt.Errorf("Interface %s: invalid ip %s", i.Name, ip)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (n *NetworkAction) writeNetworkd(context *DebosContext) error {
+	dir := path.Join(context.rootdir, "etc/systemd/network")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range n.Interfaces {
+		if i.Kind == "bridge" {
+			netdev := fmt.Sprintf("[NetDev]\nName=%s\nKind=bridge\n", i.Name)
+			err = ioutil.WriteFile(path.Join(dir, fmt.Sprintf("50-debos-%s.netdev", i.Name)),
+				[]byte(netdev), 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		var network strings.Builder
+		fmt.Fprintf(&network, "[Match]\nName=%s\n\n[Network]\n", i.Name)
+		if i.DHCP {
+			network.WriteString("DHCP=yes\n")
+		}
+		for _, a := range i.Addresses {
+			fmt.Fprintf(&network, "Address=%s\n", a)
+		}
+		if i.Gateway != "" {
+			fmt.Fprintf(&network, "Gateway=%s\n", i.Gateway)
+		}
+		for _, d := range i.DNS {
+			fmt.Fprintf(&network, "DNS=%s\n", d)
+		}
+		if i.Bridge != "" {
+			fmt.Fprintf(&network, "Bridge=%s\n", i.Bridge)
+		}
+
+		err = ioutil.WriteFile(path.Join(dir, fmt.Sprintf("50-debos-%s.network", i.Name)),
+			[]byte(network.String()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func inetFamily(cidr string) string {
+	ip, _, _ := net.ParseCIDR(cidr)
+	if ip.To4() == nil {
+		return "inet6"
+	}
+	return "inet"
+}
+
+func (n *NetworkAction) writeIfupdown(context *DebosContext) error {
+	dir := path.Join(context.rootdir, "etc/network/interfaces.d")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range n.Interfaces {
+		var stanza strings.Builder
+		fmt.Fprintf(&stanza, "auto %s\n", i.Name)
+
+		method := "manual"
+		if i.DHCP {
+			method = "dhcp"
+		}
+
+		/* ifupdown takes a single address per stanza, start with the first
+		 * one and add the others as extra stanzas */
+		var addresses []string
+		if len(i.Addresses) > 0 {
+			addresses = i.Addresses[1:]
+			fmt.Fprintf(&stanza, "iface %s %s static\n\taddress %s\n", i.Name,
+				inetFamily(i.Addresses[0]), i.Addresses[0])
+		} else {
+			fmt.Fprintf(&stanza, "iface %s inet %s\n", i.Name, method)
+		}
+
+		if i.Gateway != "" {
+			fmt.Fprintf(&stanza, "\tgateway %s\n", i.Gateway)
+		}
+		if len(i.DNS) > 0 {
+			fmt.Fprintf(&stanza, "\tdns-nameservers %s\n", strings.Join(i.DNS, " "))
+		}
+		if i.Kind == "bridge" {
+			var ports []string
+			for _, p := range n.Interfaces {
+				if p.Bridge == i.Name {
+					ports = append(ports, p.Name)
+				}
+			}
+			if len(ports) == 0 {
+				ports = append(ports, "none")
+			}
+			fmt.Fprintf(&stanza, "\tbridge_ports %s\n", strings.Join(ports, " "))
+		}
+		for _, a := range addresses {
+			fmt.Fprintf(&stanza, "\niface %s %s static\n\taddress %s\n", i.Name, inetFamily(a), a)
+		}
+
+		err = ioutil.WriteFile(path.Join(dir, i.Name), []byte(stanza.String()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *NetworkAction) Run(context *DebosContext) error {
+	n.LogStart()
+
+	var err error
+	var service string
+	switch n.Backend {
+	case "networkd":
+		err = n.writeNetworkd(context)
+		service = "systemd-networkd.service"
+	case "ifupdown":
+		err = n.writeIfupdown(context)
+		service = "networking.service"
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't write network configuration: %v", err)
+	}
+
+	return Command{}.Run("systemctl", "systemctl",
+		fmt.Sprintf("--root=%s", context.rootdir), "enable", service)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/* Stamps the image with its identity: fields are set in /etc/os-release and
+ * buildinfo is written to /etc/build-info, both in os-release syntax. Values
+ * typically come from template variables. In merge mode (the default) the
+ * existing os-release keys are kept and only the given ones overridden */
+type OsReleaseAction struct {
+	BaseAction `yaml:",inline"`
+	Mode       string
+	Fields     map[string]string
+	BuildInfo  map[string]string
+}
+
+var osReleaseKeyRegexp = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+func newOsReleaseAction() *OsReleaseAction {
+	return &OsReleaseAction{Mode: "merge"}
+}
+
+func (osr *OsReleaseAction) Verify(context *DebosContext) error {
+	switch osr.Mode {
+	case "merge", "overwrite":
+	default:
+		return fmt.Errorf("Unknown os-release mode %s", osr.Mode)
+	}
+
+	if len(osr.Fields) == 0 && len(osr.BuildInfo) == 0 {
+		return errors.New("No os-release fields or build info given")
+	}
+
+	for _, fields := range []map[string]string{osr.Fields, osr.BuildInfo} {
+		for k := range fields {
+			if !osReleaseKeyRegexp.MatchString(k) {
+				return fmt.Errorf("Invalid os-release key %s", k)
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Value quoted as for a shell, as os-release(5) asks for */
+func quoteOsReleaseValue(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return `"` + r.Replace(v) + `"`
+}
+
+/* Lines for the given fields, sorted so the output is reproducible */
+func osReleaseLines(fields map[string]string) []string {
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, quoteOsReleaseValue(fields[k])))
+	}
+	return lines
+}
+
+/* Existing lines, replacing those that set one of the fields, followed by
+ * the fields that weren't set before */
+func mergeOsRelease(current string, fields map[string]string) []string {
+	remaining := make(map[string]string)
+	for k, v := range fields {
+		remaining[k] = v
+	}
+
+	var lines []string
+	for _, l := range strings.Split(strings.TrimRight(current, "\n"), "\n") {
+		key := strings.SplitN(strings.TrimSpace(l), "=", 2)[0]
+		if v, ok := remaining[key]; ok {
+			l = fmt.Sprintf("%s=%s", key, quoteOsReleaseValue(v))
+			delete(remaining, key)
+		}
+		lines = append(lines, l)
+	}
+
+	return append(lines, osReleaseLines(remaining)...)
+}
+
+/* /etc/os-release is usually a symlink to /usr/lib/os-release, so write the
+ * file it points to in the rootfs rather than replacing the link */
+func osReleaseFile(rootdir string) string {
+	file := path.Join(rootdir, "etc/os-release")
+	target, err := os.Readlink(file)
+	if err != nil {
+		return file
+	}
+
+	if path.IsAbs(target) {
+		return path.Join(rootdir, target)
+	}
+	return path.Join(rootdir, CleanPathAt(target, "/etc"))
+}
+
+func (osr *OsReleaseAction) Run(context *DebosContext) error {
+	osr.LogStart()
+
+	if len(osr.Fields) > 0 {
+		file := osReleaseFile(context.rootdir)
+		lines := osReleaseLines(osr.Fields)
+		if osr.Mode == "merge" {
+			current, err := ioutil.ReadFile(file)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Couldn't read os-release: %v", err)
+			}
+			if len(current) > 0 {
+				lines = mergeOsRelease(string(current), osr.Fields)
+			}
+		}
+
+		err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't write os-release: %v", err)
+		}
+	}
+
+	if len(osr.BuildInfo) > 0 {
+		content := strings.Join(osReleaseLines(osr.BuildInfo), "\n") + "\n"
+		err := ioutil.WriteFile(path.Join(context.rootdir, "etc/build-info"), []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't write build-info: %v", err)
+		}
+	}
+
+	return nil
+}
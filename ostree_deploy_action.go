@@ -33,7 +33,7 @@ func (ot *OstreeDeployAction) setupFSTab(deployment *ostree.Deployment, context
 
 	etcDir := path.Join(context.imageMntDir, deploymentDir, "etc")
 
-	err := os.Mkdir(etcDir, 755)
+	err := os.Mkdir(etcDir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -1,16 +1,53 @@
 package main
 
 import (
+	"fmt"
 	"path"
+	"sort"
 )
 
 type OverlayAction struct {
-	BaseAction `yaml:",inline"`
-	Source     string
+	BaseAction   `yaml:",inline"`
+	Source       string
+	Rootdir      string            // Subdirectory of the rootfs to copy into
+	Capabilities map[string]string // File capabilities to set after copying, by path
+}
+
+func (overlay *OverlayAction) Verify(context *DebosContext) error {
+	return checkSubRootdir(overlay.Rootdir)
+}
+
+/* Set file capabilities with the hosts setcap, so the target doesn't need
+ * to have it installed */
+func setCapabilities(rootdir string, caps map[string]string) error {
+	var files []string
+	for f := range caps {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		err := Command{}.Run("setcap", "setcap", caps[f], path.Join(rootdir, f))
+		if err != nil {
+			return fmt.Errorf("Couldn't set capabilities on %s: %v", f, err)
+		}
+	}
+
+	return nil
 }
 
 func (overlay *OverlayAction) Run(context *DebosContext) error {
 	overlay.LogStart()
+	rootdir, err := context.subRootdir(overlay.Rootdir)
+	if err != nil {
+		return err
+	}
 	sourcedir := path.Join(context.recipeDir, overlay.Source)
-	return CopyTree(sourcedir, context.rootdir)
+	checkUsrLayout(sourcedir, rootdir)
+	err = CopyTree(sourcedir, rootdir)
+	if err != nil {
+		return err
+	}
+
+	return setCapabilities(rootdir, overlay.Capabilities)
 }
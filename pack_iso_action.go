@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+/* Packs a directory of the rootfs as an ISO9660 image in the artifact
+ * directory, bootable through El Torito from BIOS (e.g. isolinux) and/or
+ * UEFI (a FAT image holding EFI/BOOT). With an isohybrid MBR the result
+ * boots when written to a USB stick as well. Boot files are paths inside
+ * the packed directory, except for the MBR which is taken from the rootfs */
+type PackIsoAction struct {
+	BaseAction   `yaml:",inline"`
+	File         string
+	Source       string // Directory in the rootfs to pack
+	Volume       string // Volume id
+	BootImage    string // BIOS boot image, e.g. isolinux/isolinux.bin
+	BootCatalog  string
+	EfiImage     string // e.g. boot/grub/efi.img
+	IsohybridMbr string // e.g. /usr/lib/ISOLINUX/isohdpfx.bin
+}
+
+func newPackIsoAction() *PackIsoAction {
+	return &PackIsoAction{Source: "/", Volume: "DEBOS", BootCatalog: "boot.cat"}
+}
+
+func (pi *PackIsoAction) Verify(context *DebosContext) error {
+	if pi.File == "" {
+		return errors.New("No file to write the ISO image to")
+	}
+
+	if len(pi.Volume) > 32 {
+		return fmt.Errorf("Volume id %s is longer than 32 characters", pi.Volume)
+	}
+
+	if pi.IsohybridMbr != "" && pi.BootImage == "" {
+		return errors.New("An isohybrid MBR needs a BIOS boot image")
+	}
+
+	return nil
+}
+
+func (pi *PackIsoAction) Run(context *DebosContext) error {
+	pi.LogStart()
+	source := path.Join(context.rootdir, pi.Source)
+	outfile := path.Join(context.artifactdir, pi.File)
+
+	for _, f := range []string{pi.BootImage, pi.EfiImage} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(path.Join(source, f)); err != nil {
+			return fmt.Errorf("Couldn't find boot image: %v", err)
+		}
+	}
+
+	cmdline := []string{"xorriso", "-as", "mkisofs", "-o", outfile,
+		"-V", pi.Volume, "-r", "-J", "-joliet-long"}
+
+	if pi.BootImage != "" || pi.EfiImage != "" {
+		cmdline = append(cmdline, "-c", pi.BootCatalog)
+	}
+	if pi.BootImage != "" {
+		cmdline = append(cmdline, "-b", pi.BootImage, "-no-emul-boot",
+			"-boot-load-size", "4", "-boot-info-table")
+	}
+	if pi.IsohybridMbr != "" {
+		cmdline = append(cmdline, "-isohybrid-mbr", path.Join(context.rootdir, pi.IsohybridMbr))
+	}
+	if pi.EfiImage != "" {
+		if pi.BootImage != "" {
+			cmdline = append(cmdline, "-eltorito-alt-boot")
+		}
+		cmdline = append(cmdline, "-e", pi.EfiImage, "-no-emul-boot")
+		/* Also make the EFI image visible as a partition when written
+		 * to a disk */
+		if pi.IsohybridMbr != "" {
+			cmdline = append(cmdline, "-isohybrid-gpt-basdat")
+		}
+	}
+	cmdline = append(cmdline, source)
+
+	log.Printf("Writing ISO image to %s\n", outfile)
+	return Command{}.Run("pack-iso", cmdline...)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+/* Packs the rootfs as a single layer container image, written as an OCI
+ * image layout archive to the artifact directory. Such an archive can be
+ * used with e.g. podman load or skopeo copy oci-archive:<file> */
+type PackOCIAction struct {
+	BaseAction `yaml:",inline"`
+	File       string
+	Tag        string
+	Entrypoint []string
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	Labels     map[string]string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+/* OCI architecture and variant per debian architecture */
+var ociArchitectures = map[string][2]string{
+	"amd64": {"amd64", ""},
+	"i386":  {"386", ""},
+	"arm64": {"arm64", "v8"},
+	"armhf": {"arm", "v7"},
+	"armel": {"arm", "v5"},
+}
+
+func newPackOCIAction() *PackOCIAction {
+	return &PackOCIAction{Tag: "latest"}
+}
+
+func (po *PackOCIAction) Verify(context *DebosContext) error {
+	if po.File == "" {
+		return errors.New("No file to write the container image to")
+	}
+	if _, ok := ociArchitectures[context.Architecture]; !ok {
+		return fmt.Errorf("No OCI architecture for %s", context.Architecture)
+	}
+	return nil
+}
+
+/* Store a file as a blob, named after its digest */
+func ociAddBlob(layout, file, mediaType string) (ociDescriptor, error) {
+	sum, err := fileSha256(file)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	err = os.Rename(file, path.Join(layout, "blobs/sha256", sum))
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + sum, Size: info.Size()}, nil
+}
+
+func ociAddJSONBlob(layout string, v interface{}, mediaType string) (ociDescriptor, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	file := path.Join(layout, "blob.json")
+	err = ioutil.WriteFile(file, content, 0644)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return ociAddBlob(layout, file, mediaType)
+}
+
+func (po *PackOCIAction) Run(context *DebosContext) error {
+	po.LogStart()
+
+	layout, err := ioutil.TempDir(context.scratchdir, "oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layout)
+
+	err = os.MkdirAll(path.Join(layout, "blobs/sha256"), 0755)
+	if err != nil {
+		return err
+	}
+
+	/* The config refers to the uncompressed layer, the manifest to the
+	 * compressed one */
+	layer := path.Join(layout, "layer.tar")
+	err = Command{}.Run("pack-oci", "tar", "--numeric-owner", "--xattrs", "-cf", layer,
+		"-C", context.rootdir, ".")
+	if err != nil {
+		return err
+	}
+	diffID, err := fileSha256(layer)
+	if err != nil {
+		return err
+	}
+
+	err = Command{}.Run("pack-oci", "gzip", "-n", layer)
+	if err != nil {
+		return err
+	}
+	layerDesc, err := ociAddBlob(layout, layer+".gz", "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		return err
+	}
+
+	arch := ociArchitectures[context.Architecture]
+	config := map[string]interface{}{
+		"architecture": arch[0],
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Entrypoint": po.Entrypoint,
+			"Cmd":        po.Cmd,
+			"Env":        po.Env,
+			"WorkingDir": po.WorkingDir,
+			"Labels":     po.Labels,
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{"sha256:" + diffID},
+		},
+	}
+	if arch[1] != "" {
+		config["variant"] = arch[1]
+	}
+	configDesc, err := ociAddJSONBlob(layout, config, "application/vnd.oci.image.config.v1+json")
+	if err != nil {
+		return err
+	}
+
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        configDesc,
+		"layers":        []ociDescriptor{layerDesc},
+	}
+	manifestDesc, err := ociAddJSONBlob(layout, manifest, "application/vnd.oci.image.manifest.v1+json")
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": po.Tag}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(layout, "index.json"), index, 0644)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(layout, "oci-layout"),
+		[]byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	if err != nil {
+		return err
+	}
+
+	outfile := path.Join(context.artifactdir, po.File)
+	log.Printf("Writing container image to %s\n", outfile)
+	return Command{}.Run("pack-oci", "tar", "-cf", outfile, "-C", layout,
+		"oci-layout", "index.json", "blobs")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+type PacmanBootstrapAction struct {
+	BaseAction `yaml:",inline"`
+	Config     string // pacman.conf to use, relative to the recipe
+	Mirrorlist string // mirrorlist to install in the target, relative to the recipe
+	Packages   []string
+}
+
+func (pb *PacmanBootstrapAction) Verify(context *DebosContext) error {
+	if len(pb.Packages) == 0 {
+		return errors.New("No packages to bootstrap")
+	}
+
+	for _, f := range []string{pb.Config, pb.Mirrorlist} {
+		if f == "" {
+			continue
+		}
+		_, err := os.Stat(CleanPathAt(f, context.recipeDir))
+		if err != nil {
+			return fmt.Errorf("Couldn't find %s: %v", f, err)
+		}
+	}
+
+	return nil
+}
+
+func (pb *PacmanBootstrapAction) Run(context *DebosContext) error {
+	return runBootstrap(pb, context)
+}
+
+func (pb *PacmanBootstrapAction) Bootstrap(context *DebosContext) error {
+	/* Don't pull in the hosts keyring or mirrorlist */
+	cmdline := []string{"pacstrap", "-G", "-M"}
+
+	if pb.Config != "" {
+		cmdline = append(cmdline, "-C", CleanPathAt(pb.Config, context.recipeDir))
+	}
+
+	cmdline = append(cmdline, context.rootdir)
+	cmdline = append(cmdline, pb.Packages...)
+
+	err := Command{}.Run("pacstrap", cmdline...)
+	if err != nil {
+		return err
+	}
+
+	if pb.Mirrorlist != "" {
+		err = os.MkdirAll(path.Join(context.rootdir, "etc/pacman.d"), 0755)
+		if err != nil {
+			return err
+		}
+		err = CopyFile(CleanPathAt(pb.Mirrorlist, context.recipeDir),
+			path.Join(context.rootdir, "etc/pacman.d/mirrorlist"), 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't install mirrorlist: %v", err)
+		}
+	}
+
+	return nil
+}
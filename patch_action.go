@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type PatchAction struct {
+	BaseAction `yaml:",inline"`
+	Source     string
+	Strip      int
+	Fuzz       int // Context lines that may not match, none by default
+}
+
+func newPatchAction() *PatchAction {
+	return &PatchAction{Strip: 1}
+}
+
+func (pa *PatchAction) Verify(context *DebosContext) error {
+	source := CleanPathAt(pa.Source, context.recipeDir)
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		return fmt.Errorf("Couldn't read patch %s: %v", pa.Source, err)
+	}
+
+	if !bytes.Contains(content, []byte("\n+++ ")) ||
+		!bytes.Contains(content, []byte("\n@@ ")) {
+		return fmt.Errorf("%s doesn't look like a unified diff", pa.Source)
+	}
+
+	if pa.Fuzz < 0 {
+		return fmt.Errorf("Invalid fuzz %d", pa.Fuzz)
+	}
+	if context.linting {
+		return nil
+	}
+
+	/* The rootfs isn't there yet, so dry run against the files as far as the
+	 * patch shows them */
+	dir, err := ioutil.TempDir("", "debos-patch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	err = pa.writeTargets(content, dir)
+	if err != nil {
+		return fmt.Errorf("Patch %s: %v", pa.Source, err)
+	}
+
+	err = Command{}.Run("patch (verify)", pa.cmdline(dir, source, true)...)
+	if err != nil {
+		return fmt.Errorf("Patch %s doesn't apply to its own context: %v", pa.Source, err)
+	}
+
+	return nil
+}
+
+func (pa *PatchAction) cmdline(dir, source string, dryrun bool) []string {
+	cmdline := []string{"patch", "--batch", "--forward",
+		fmt.Sprintf("-p%d", pa.Strip), fmt.Sprintf("--fuzz=%d", pa.Fuzz),
+		"-d", dir, "-i", source}
+	if dryrun {
+		cmdline = append(cmdline, "--dry-run")
+	}
+	return cmdline
+}
+
+/* File name of a --- or +++ line, as patch finds it after stripping */
+func (pa *PatchAction) targetName(line string) string {
+	name := strings.TrimSpace(strings.SplitN(line[4:], "\t", 2)[0])
+	if name == "/dev/null" {
+		return ""
+	}
+	parts := strings.SplitN(name, "/", pa.Strip+1)
+	if len(parts) <= pa.Strip {
+		return ""
+	}
+	return parts[pa.Strip]
+}
+
+/* Line count of one side of a hunk range, e.g. 12,3 or just 12 */
+func hunkLength(r string) (int, error) {
+	fields := strings.SplitN(r[1:], ",", 2)
+	if len(fields) == 1 {
+		return 1, nil
+	}
+	return strconv.Atoi(fields[1])
+}
+
+/* Rebuild what the patch expects of its targets from the context and removed
+ * lines of its hunks, one after the other */
+func (pa *PatchAction) writeTargets(content []byte, dir string) error {
+	files := make(map[string]*bytes.Buffer)
+	var order []string
+	var current *bytes.Buffer
+	oldName := ""
+	oldLeft, newLeft := 0, 0
+
+	for _, l := range strings.SplitAfter(string(content), "\n") {
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case l == "":
+				return errors.New("Patch ends in the middle of a hunk")
+			case strings.HasPrefix(l, "+"):
+				newLeft--
+			case strings.HasPrefix(l, "-"):
+				oldLeft--
+				current.WriteString(l[1:])
+			case strings.HasPrefix(l, `\`):
+			case l == "\n":
+				oldLeft--
+				newLeft--
+				current.WriteString(l)
+			default:
+				oldLeft--
+				newLeft--
+				current.WriteString(l[1:])
+			}
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(l, "--- "):
+			oldName = pa.targetName(l)
+		case strings.HasPrefix(l, "+++ "):
+			name := oldName
+			if name == "" {
+				/* New files get created, a buffer keeps the hunks in order */
+				name = pa.targetName(l)
+			}
+			if name == "" {
+				return fmt.Errorf("Can't strip %d components from %s", pa.Strip, strings.TrimSpace(l))
+			}
+			if _, ok := files[name]; !ok {
+				files[name] = new(bytes.Buffer)
+				if oldName != "" {
+					order = append(order, name)
+				}
+			}
+			current = files[name]
+		case strings.HasPrefix(l, "@@ "):
+			fields := strings.Fields(l)
+			if current == nil || len(fields) < 3 {
+				return fmt.Errorf("Invalid hunk %s", strings.TrimSpace(l))
+			}
+			var err error
+			oldLeft, err = hunkLength(fields[1])
+			if err != nil {
+				return fmt.Errorf("Invalid hunk %s", strings.TrimSpace(l))
+			}
+			newLeft, err = hunkLength(fields[2])
+			if err != nil {
+				return fmt.Errorf("Invalid hunk %s", strings.TrimSpace(l))
+			}
+		}
+	}
+
+	for _, name := range order {
+		file := path.Join(dir, name)
+		err := os.MkdirAll(path.Dir(file), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(file, files[name].Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pa *PatchAction) Run(context *DebosContext) error {
+	pa.LogStart()
+	source := CleanPathAt(pa.Source, context.recipeDir)
+
+	/* Dry run first so a patch that doesn't fully apply leaves the rootfs
+	 * untouched */
+	err := Command{}.Run("patch (dry-run)", pa.cmdline(context.rootdir, source, true)...)
+	if err != nil {
+		return fmt.Errorf("Patch %s doesn't apply cleanly: %v", pa.Source, err)
+	}
+
+	return Command{}.Run("patch", pa.cmdline(context.rootdir, source, false)...)
+}
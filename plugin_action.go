@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+)
+
+/* Actions outside of debos are executables named debos-action-TYPE in one of
+ * the plugin directories. For each stage they are run with the stage
+ * (verify, run, cleanup or postmachine) as argument and a JSON document on
+ * stdin holding the action's recipe settings and where the build happens:
+ *
+ *  {"stage": "run", "action": {...}, "context": {"rootdir": ..., ...}}
+ *
+ * Their output ends up in the log and exiting non-zero fails the stage */
+type PluginAction struct {
+	BaseAction `yaml:",inline"`
+	plugin     string
+	settings   map[string]interface{}
+}
+
+var pluginDirs = []string{"/usr/lib/debos/plugins"}
+
+func findPlugin(action string) (string, bool) {
+	for _, d := range pluginDirs {
+		exe := path.Join(d, "debos-action-"+action)
+		if st, err := os.Stat(exe); err == nil && st.Mode()&0111 != 0 {
+			return exe, true
+		}
+	}
+	return "", false
+}
+
+/* yaml decodes mappings with interface{} keys, which JSON can't have */
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range v {
+			m[fmt.Sprintf("%v", k)] = jsonCompatible(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range v {
+			m[k] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+	}
+	return v
+}
+
+func (pa *PluginAction) runStage(stage string, context *DebosContext) error {
+	request := map[string]interface{}{
+		"stage":  stage,
+		"action": jsonCompatible(pa.settings),
+		"context": map[string]string{
+			"rootdir":      context.rootdir,
+			"artifactdir":  context.artifactdir,
+			"scratchdir":   context.scratchdir,
+			"recipedir":    context.recipeDir,
+			"architecture": context.Architecture,
+			"image":        context.image,
+			"imagemntdir":  context.imageMntDir,
+		},
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	label := path.Base(pa.plugin)
+	w := newCommandWrapper(label, nil)
+	exe := exec.Command(pa.plugin, stage)
+	exe.Stdin = bytes.NewReader(input)
+	exe.Stdout = w
+	exe.Stderr = w
+
+	err = exe.Run()
+	w.flush()
+	if err != nil {
+		w.showTail()
+		return fmt.Errorf("%s %s failed: %v", label, stage, err)
+	}
+
+	return nil
+}
+
+func (pa *PluginAction) Verify(context *DebosContext) error {
+	/* Plugins can only check their settings by running */
+	if context.linting {
+		return nil
+	}
+	return pa.runStage("verify", context)
+}
+
+func (pa *PluginAction) Run(context *DebosContext) error {
+	pa.LogStart()
+	return pa.runStage("run", context)
+}
+
+func (pa *PluginAction) Cleanup(context DebosContext) error {
+	return pa.runStage("cleanup", &context)
+}
+
+func (pa *PluginAction) PostMachine(context DebosContext) error {
+	return pa.runStage("postmachine", &context)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/debos/fakemachine"
+)
+
+/* Builds another recipe as a separate debos run, with its own scratch
+ * space, rootfs and machine, before this one starts. The artifact it
+ * produces ends up in the artifact directory, for e.g. a firmware image to
+ * be embedded by later actions, and its path is set as the recipe.OUTPUT
+ * value */
+type RecipeAction struct {
+	BaseAction `yaml:",inline"`
+	Recipe     string            // Relative to this recipe
+	Variables  map[string]string // Template variables for the recipe
+	Artifact   string            // File the recipe produces
+	Output     string            // Name in the artifact directory, defaults to the artifact's
+}
+
+func (ra *RecipeAction) Verify(context *DebosContext) error {
+	if ra.Recipe == "" {
+		return errors.New("No recipe given")
+	}
+	ra.Recipe = CleanPathAt(ra.Recipe, context.recipeDir)
+	if _, err := os.Stat(ra.Recipe); err != nil {
+		return fmt.Errorf("Couldn't find recipe: %v", err)
+	}
+
+	if ra.Artifact == "" {
+		return errors.New("No artifact to take from the recipe")
+	}
+	if ra.Output == "" {
+		ra.Output = path.Base(ra.Artifact)
+	}
+
+	context.SetValue("recipe."+ra.Output, path.Join(context.artifactdir, ra.Output))
+
+	return nil
+}
+
+func (ra *RecipeAction) build(context *DebosContext) error {
+	ra.LogStart()
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Couldn't find debos executable: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "debos-recipe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	artifactdir := path.Join(tmp, "artifacts")
+	scratchdir := path.Join(tmp, "scratch")
+	for _, d := range []string{artifactdir, scratchdir} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"--artifactdir", artifactdir, "--scratchdir", scratchdir}
+	var keys []string
+	for k := range ra.Variables {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-t", fmt.Sprintf("%s:%s", k, ra.Variables[k]))
+	}
+	args = append(args, ra.Recipe)
+
+	err = Command{}.Run(path.Base(ra.Recipe), append([]string{self}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	return CopyFile(path.Join(artifactdir, ra.Artifact), path.Join(context.artifactdir, ra.Output), 0644)
+}
+
+func (ra *RecipeAction) PreMachine(context *DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	return ra.build(context)
+}
+
+func (ra *RecipeAction) PreNoMachine(context *DebosContext) error {
+	return ra.build(context)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/debos/fakemachine"
+)
+
+type actionReport struct {
+	Action   string  `json:"action"`
+	Stage    string  `json:"stage"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type artifactReport struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type partitionReport struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+type imageReport struct {
+	File       string            `json:"file"`
+	Size       int64             `json:"size"`
+	Partitions []partitionReport `json:"partitions"`
+}
+
+type diskUsageReport struct {
+	Mountpoint string `json:"mountpoint"`
+	Used       int64  `json:"used"`
+	Free       int64  `json:"free"`
+	Usage      int    `json:"usage"`
+}
+
+type hostReport struct {
+	Hostname string `json:"hostname"`
+	Kernel   string `json:"kernel"`
+	Arch     string `json:"arch"`
+}
+
+/* Summary of a build as written by --report. When running in a fakemachine
+ * the inner debos records the stages it ran to the same file, which the outer
+ * debos picks up and completes with the artifacts */
+type buildReport struct {
+	Version   string            `json:"version"`
+	Recipe    string            `json:"recipe"`
+	Variables map[string]string `json:"variables"`
+	Host      hostReport        `json:"host"`
+	Started   time.Time         `json:"started"`
+	Status    string            `json:"status"`
+	Actions   []actionReport    `json:"actions"`
+	Artifacts []artifactReport  `json:"artifacts,omitempty"`
+	Image     *imageReport      `json:"image,omitempty"`
+	DiskUsage []diskUsageReport `json:"disk_usage,omitempty"`
+
+	file    string
+	context *DebosContext
+}
+
+var report *buildReport
+
+func newBuildReport(file, recipe string, vars map[string]string, context *DebosContext) *buildReport {
+	r := &buildReport{
+		Version:   Version,
+		Recipe:    recipe,
+		Variables: vars,
+		Started:   time.Now(),
+		Status:    "running",
+		file:      file,
+		context:   context,
+	}
+
+	r.Host.Hostname, _ = os.Hostname()
+	kernel, _ := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	r.Host.Kernel = strings.TrimSpace(string(kernel))
+	r.Host.Arch = runtime.GOARCH
+
+	return r
+}
+
+func (r *buildReport) addStage(a Action, stage string, d time.Duration, err error) {
+	if r == nil {
+		return
+	}
+
+	entry := actionReport{
+		Action:   a.String(),
+		Stage:    stage,
+		Status:   "success",
+		Duration: d.Seconds(),
+	}
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = redact(err.Error())
+	}
+
+	r.Actions = append(r.Actions, entry)
+}
+
+func (r *buildReport) addDiskUsage(u diskUsageReport) {
+	if r == nil {
+		return
+	}
+	r.DiskUsage = append(r.DiskUsage, u)
+}
+
+/* Pick up the stages recorded by the debos running in the fakemachine */
+func (r *buildReport) merge() {
+	if r == nil {
+		return
+	}
+
+	content, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return
+	}
+
+	var inner buildReport
+	if json.Unmarshal(content, &inner) == nil {
+		r.Actions = append(r.Actions, inner.Actions...)
+		r.DiskUsage = append(r.DiskUsage, inner.DiskUsage...)
+	}
+}
+
+func fileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* Artifacts are the files in the artifact directory written during the
+ * build */
+func (r *buildReport) collectArtifacts() {
+	artifactdir := r.context.artifactdir
+	filepath.Walk(artifactdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || p == r.file {
+			return nil
+		}
+		if info.ModTime().Before(r.Started) {
+			return nil
+		}
+
+		sum, err := fileSha256(p)
+		if err != nil {
+			log.Printf("Couldn't checksum %s: %v", p, err)
+		}
+		name, _ := filepath.Rel(artifactdir, p)
+		r.Artifacts = append(r.Artifacts, artifactReport{name, info.Size(), sum})
+		return nil
+	})
+}
+
+func (r *buildReport) collectImage() {
+	if r.context.imageFile == "" {
+		return
+	}
+
+	info, err := os.Stat(r.context.imageFile)
+	if err != nil {
+		return
+	}
+
+	img := &imageReport{File: r.context.imageFile, Size: info.Size()}
+	for name, number := range r.context.imagePartitions {
+		offset, size, err := imagePartitionRange(r.context.imageFile, number)
+		if err != nil {
+			log.Printf("Couldn't get geometry of partition %s: %v", name, err)
+			continue
+		}
+		img.Partitions = append(img.Partitions, partitionReport{name, number, offset, size})
+	}
+
+	sort.Slice(img.Partitions, func(a, b int) bool {
+		return img.Partitions[a].Number < img.Partitions[b].Number
+	})
+
+	r.Image = img
+}
+
+func (r *buildReport) finish(status string) {
+	if r == nil {
+		return
+	}
+
+	r.Status = status
+	/* Artifacts only really exist once the outermost debos is done */
+	if !fakemachine.InMachine() {
+		r.collectArtifacts()
+		r.collectImage()
+	}
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(r.file, content, 0644)
+	}
+	if err != nil {
+		log.Printf("Couldn't write report %s: %v", r.file, err)
+	}
+}
@@ -4,22 +4,77 @@ import (
 	"errors"
 	"fmt"
 	"github.com/debos/fakemachine"
+	"io/ioutil"
+	"os"
 	"path"
+	"strings"
 )
 
+/* Runs a command or a script file, on the host or in the rootfs. A script
+ * run in the chroot is copied into the rootfs for the time being, keeping its
+ * permissions, e.g.
+ *
+ *  - action: run
+ *    chroot: true
+ *    script: scripts/setup-user.sh
+ *    args: [user, 1000]
+ */
 type RunAction struct {
 	BaseAction  `yaml:",inline"`
 	Chroot      bool
 	PostProcess bool
-	Script      string
+	Script      string   // File relative to the recipe
+	Args        []string // Arguments of the script
 	Command     string
+	Rootdir     string // Subdirectory of the rootfs to run in
+	Stdin       string // Input of the command or script
+	Values      bool   // Expand value calls in the command and stdin when running
 }
 
 func (run *RunAction) Verify(context *DebosContext) error {
 	if run.PostProcess && run.Chroot {
 		return errors.New("Cannot run postprocessing in the chroot")
 	}
-	return nil
+	if run.Rootdir != "" && run.PostProcess {
+		return errors.New("Cannot use a rootdir when postprocessing")
+	}
+	if len(run.Args) > 0 && run.Script == "" {
+		return errors.New("Arguments are only passed to a script")
+	}
+	if run.Script != "" {
+		script := CleanPathAt(run.Script, context.recipeDir)
+		info, err := os.Stat(script)
+		if err != nil {
+			return fmt.Errorf("Couldn't find script: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("Script %s isn't a file", script)
+		}
+	}
+	return checkSubRootdir(run.Rootdir)
+}
+
+/* Copy the script into the rootfs it's run in, so it doesn't depend on what
+ * else is in its directory. It goes to /var/tmp, as nspawn mounts a tmpfs
+ * over /tmp; the returned directory has to be removed after */
+func (run *RunAction) stageScript(rootdir, script string) (string, error) {
+	info, err := os.Stat(script)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir(path.Join(rootdir, "var/tmp"), "debos-run-")
+	if err != nil {
+		return "", err
+	}
+
+	err = CopyFile(script, path.Join(dir, path.Base(script)), info.Mode().Perm())
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
 }
 
 func (run *RunAction) PreMachine(context *DebosContext, m *fakemachine.Machine,
@@ -29,9 +84,9 @@ func (run *RunAction) PreMachine(context *DebosContext, m *fakemachine.Machine,
 		return nil
 	}
 
-	run.Script = CleanPathAt(run.Script, context.recipeDir)
+	script := CleanPathAt(run.Script, context.recipeDir)
 	if !run.PostProcess {
-		m.AddVolume(path.Dir(run.Script))
+		m.AddVolume(path.Dir(script))
 	}
 
 	return nil
@@ -43,33 +98,71 @@ func (run *RunAction) doRun(context DebosContext) error {
 	var label string
 	var cmd Command
 
+	rootdir, err := context.subRootdir(run.Rootdir)
+	if err != nil {
+		return err
+	}
+
 	if run.Chroot {
-		cmd = NewChrootCommand(context.rootdir, context.Architecture)
+		cmd = NewChrootCommand(rootdir, context.Architecture)
 	} else {
 		cmd = Command{}
 	}
 
 	if run.Script != "" {
-		run.Script = CleanPathAt(run.Script, context.recipeDir)
+		script := CleanPathAt(run.Script, context.recipeDir)
 		if run.Chroot {
-			cmd.AddBindMount(path.Dir(run.Script), "/script")
-			cmdline = []string{fmt.Sprintf("/script/%s", path.Base(run.Script))}
+			dir, err := run.stageScript(rootdir, script)
+			if err != nil {
+				return fmt.Errorf("Couldn't copy script into the rootfs: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			cmdline = []string{path.Join("/", strings.TrimPrefix(dir, rootdir), path.Base(script))}
 		} else {
-			cmdline = []string{run.Script}
+			cmdline = []string{script}
 		}
-		label = path.Base(run.Script)
+		cmdline = append(cmdline, run.Args...)
+		label = path.Base(script)
 	} else {
-		cmdline = []string{"sh", "-c", run.Command}
-		label = run.Command
+		command, err := run.expandValues(context, "command", run.Command)
+		if err != nil {
+			return err
+		}
+		cmdline = []string{"sh", "-c", command}
+		label = command
 	}
 
 	if !run.Chroot && !run.PostProcess {
-		cmd.AddEnvKey("ROOTDIR", context.rootdir)
+		cmd.AddEnvKey("ROOTDIR", rootdir)
+	}
+
+	if run.Stdin != "" {
+		stdin, err := run.expandValues(context, "stdin", run.Stdin)
+		if err != nil {
+			return err
+		}
+		cmd.SetStdin(stdin)
 	}
 
 	return cmd.Run(label, cmdline...)
 }
 
+func (run *RunAction) valueFields() []string {
+	if !run.Values {
+		return nil
+	}
+	return []string{run.Command, run.Stdin}
+}
+
+/* The recipe is expanded already, so only templated once more when asked
+ * for; otherwise escaped braces would be expanded a second time */
+func (run *RunAction) expandValues(context DebosContext, name, text string) (string, error) {
+	if !run.Values {
+		return text, nil
+	}
+	return context.expandTemplate(name, text)
+}
+
 func (run *RunAction) Run(context *DebosContext) error {
 	if run.PostProcess {
 		/* This runs in postprocessing instead */
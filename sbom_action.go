@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Writes a software bill of materials of the packages installed in the
+ * rootfs to the artifact directory, as SPDX or CycloneDX JSON, along with
+ * the debos version and the recipe checksum for provenance. So it has to
+ * run after the last action installing or removing packages */
+type SbomAction struct {
+	BaseAction `yaml:",inline"`
+	Format     string // spdx or cyclonedx
+	File       string
+}
+
+type sbomPackage struct {
+	name, version, arch, source, sourceVersion string
+}
+
+func (p sbomPackage) purl() string {
+	return fmt.Sprintf("pkg:deb/debian/%s@%s?arch=%s", p.name, p.version, p.arch)
+}
+
+/* SPDX ids only allow letters, digits, . and - */
+var spdxIDReplacer = strings.NewReplacer("+", "-", "_", "-", ":", "-")
+
+func newSbomAction() *SbomAction {
+	return &SbomAction{Format: "spdx"}
+}
+
+func (sb *SbomAction) Verify(context *DebosContext) error {
+	switch sb.Format {
+	case "spdx":
+		if sb.File == "" {
+			sb.File = "sbom.spdx.json"
+		}
+	case "cyclonedx":
+		if sb.File == "" {
+			sb.File = "sbom.cdx.json"
+		}
+	default:
+		return fmt.Errorf("Unknown SBOM format %s", sb.Format)
+	}
+	return nil
+}
+
+func installedPackages(rootdir string) ([]sbomPackage, error) {
+	out, err := exec.Command("dpkg-query", "--admindir", path.Join(rootdir, "var/lib/dpkg"), "-W",
+		"-f", "${db:Status-Abbrev}\t${Package}\t${Version}\t${Architecture}\t${source:Package}\t${source:Version}\n").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't list packages: %v", err)
+	}
+
+	var packages []sbomPackage
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Split(l, "\t")
+		/* Only what is actually installed, not just known */
+		if len(f) != 6 || !strings.HasPrefix(f[0], "ii") {
+			continue
+		}
+		packages = append(packages, sbomPackage{f[1], f[2], f[3], f[4], f[5]})
+	}
+
+	return packages, nil
+}
+
+/* SOURCE_DATE_EPOCH keeps the document reproducible */
+func sbomTimestamp() string {
+	t := time.Now()
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		t = time.Unix(epoch, 0)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (sb *SbomAction) spdx(context *DebosContext, packages []sbomPackage) interface{} {
+	type ref struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type pkg struct {
+		Name             string `json:"name"`
+		SPDXID           string `json:"SPDXID"`
+		VersionInfo      string `json:"versionInfo"`
+		DownloadLocation string `json:"downloadLocation"`
+		SourceInfo       string `json:"sourceInfo"`
+		ExternalRefs     []ref  `json:"externalRefs"`
+	}
+
+	var pkgs []pkg
+	for _, p := range packages {
+		pkgs = append(pkgs, pkg{
+			Name:             p.name,
+			SPDXID:           spdxIDReplacer.Replace(fmt.Sprintf("SPDXRef-Package-%s-%s", p.name, p.arch)),
+			VersionInfo:      p.version,
+			DownloadLocation: "NOASSERTION",
+			SourceInfo:       fmt.Sprintf("built from source package %s %s", p.source, p.sourceVersion),
+			ExternalRefs:     []ref{{"PACKAGE-MANAGER", "purl", p.purl()}},
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              sb.File,
+		"documentNamespace": fmt.Sprintf("https://spdx.org/spdxdocs/debos-%s-%s", sb.File, context.recipeSha256),
+		"comment":           fmt.Sprintf("Recipe sha256 %s", context.recipeSha256),
+		"creationInfo": map[string]interface{}{
+			"created":  sbomTimestamp(),
+			"creators": []string{"Tool: debos-" + Version},
+		},
+		"packages": pkgs,
+	}
+}
+
+func (sb *SbomAction) cyclonedx(context *DebosContext, packages []sbomPackage) interface{} {
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version"`
+		Purl       string     `json:"purl"`
+		Properties []property `json:"properties"`
+	}
+
+	var components []component
+	for _, p := range packages {
+		components = append(components, component{"library", p.name, p.version, p.purl(),
+			[]property{{"debian:source", p.source}, {"debian:source-version", p.sourceVersion}}})
+	}
+
+	return map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.4",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp":  sbomTimestamp(),
+			"tools":      []map[string]string{{"name": "debos", "version": Version}},
+			"properties": []property{{"debos:recipe-sha256", context.recipeSha256}},
+		},
+		"components": components,
+	}
+}
+
+func (sb *SbomAction) Run(context *DebosContext) error {
+	sb.LogStart()
+
+	packages, err := installedPackages(context.rootdir)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	if sb.Format == "cyclonedx" {
+		doc = sb.cyclonedx(context, packages)
+	} else {
+		doc = sb.spdx(context, packages)
+	}
+
+	content, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	output := path.Join(context.artifactdir, sb.File)
+	log.Printf("Writing SBOM of %d packages to %s\n", len(packages), output)
+	return ioutil.WriteFile(output, content, 0644)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/* A secret is declared in the recipe by where it comes from at build time,
+ * so the value itself never needs to be committed:
+ *
+ *  secrets:
+ *    rootpw:
+ *      env: ROOT_PASSWORD
+ *    signkey:
+ *      file: /run/keys/sign.pem
+ *
+ * Actions refer to secrets by name. Secrets are resolved once by the
+ * outermost debos, a fakemachine gets the values handed over in a private
+ * file as it can't see the environment or arbitrary host files */
+type Secret struct {
+	File string
+	Env  string
+}
+
+/* Values that must never end up in the logs */
+var redactions []string
+
+func redact(s string) string {
+	for _, r := range redactions {
+		s = strings.Replace(s, r, "<redacted>", -1)
+	}
+	return s
+}
+
+func addRedaction(value string) {
+	if value != "" {
+		redactions = append(redactions, value)
+	}
+}
+
+func (s Secret) resolve(recipeDir string) (string, error) {
+	switch {
+	case s.File != "" && s.Env != "":
+		return "", errors.New("only one of file and env can be used")
+	case s.File != "":
+		content, err := ioutil.ReadFile(CleanPathAt(s.File, recipeDir))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\n"), nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("%s not set", s.Env)
+		}
+		return value, nil
+	}
+
+	return "", errors.New("no file or env given")
+}
+
+func resolveSecrets(secrets map[string]Secret, recipeDir string) (map[string]string, error) {
+	values := make(map[string]string)
+	for name, s := range secrets {
+		value, err := s.resolve(recipeDir)
+		if err != nil {
+			return nil, fmt.Errorf("Secret %s: %v", name, err)
+		}
+		values[name] = value
+		addRedaction(value)
+	}
+
+	return values, nil
+}
+
+func writeSecrets(file string, values map[string]string) error {
+	content, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0600)
+}
+
+func readSecrets(file string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	err = json.Unmarshal(content, &values)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		addRedaction(value)
+	}
+
+	return values, nil
+}
+
+func (context *DebosContext) secret(name string) (string, error) {
+	value, ok := context.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown secret %s", name)
+	}
+	return value, nil
+}
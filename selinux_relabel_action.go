@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Labels the rootfs with the file contexts of an SELinux policy installed
+ * in it, as an enforcing system expects to find everything labeled from the
+ * first boot on. Files added later end up unlabeled, so this wants to be the
+ * last action changing the rootfs; copying the rootfs into the image with
+ * filesystem-deploy keeps the labels */
+type SELinuxRelabelAction struct {
+	BaseAction `yaml:",inline"`
+	Policy     string // Defaults to SELINUXTYPE from /etc/selinux/config
+}
+
+/* SELINUXTYPE as configured in the rootfs */
+func selinuxConfiguredPolicy(rootdir string) (string, error) {
+	f, err := os.Open(path.Join(rootdir, "etc/selinux/config"))
+	if err != nil {
+		return "", fmt.Errorf("Couldn't read SELinux config: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) == 2 && kv[0] == "SELINUXTYPE" {
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+
+	return "", errors.New("No SELINUXTYPE in the SELinux config")
+}
+
+func (sr *SELinuxRelabelAction) Verify(context *DebosContext) error {
+	if strings.Contains(sr.Policy, "/") {
+		return fmt.Errorf("Invalid SELinux policy name %s", sr.Policy)
+	}
+	return nil
+}
+
+func (sr *SELinuxRelabelAction) Run(context *DebosContext) error {
+	sr.LogStart()
+
+	policy := sr.Policy
+	if policy == "" {
+		var err error
+		policy, err = selinuxConfiguredPolicy(context.rootdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	contexts := path.Join("/etc/selinux", policy, "contexts/files/file_contexts")
+	if _, err := os.Stat(path.Join(context.rootdir, contexts)); err != nil {
+		return fmt.Errorf("SELinux policy %s isn't installed: %v", policy, err)
+	}
+
+	/* A plain chroot, nspawn would mount /proc and friends over the
+	 * directories which need labeling themselves */
+	cmd := Command{Architecture: context.Architecture, Chroot: context.rootdir,
+		ChrootMethod: CHROOT_METHOD_CHROOT}
+
+	return cmd.Run("selinux-relabel", "setfiles", "-F", contexts, "/")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/* Signs a partition of the image once it's complete, so this happens after
+ * all partitions have been unmounted. The sha256 over the partition content
+ * is signed, or, for dm-verity protected partitions, the root hash */
+type SignAction struct {
+	BaseAction         `yaml:",inline"`
+	Partition          string
+	Key                string // PEM private key
+	KeySecret          string // Secret holding the PEM private key instead
+	Output             string // Signature sidecar file in the artifact directory
+	SignaturePartition string // Partition to write the raw signature to instead
+	RootHashFile       string // Root hash in the artifact directory, the verity action's by default
+}
+
+func (s *SignAction) Verify(context *DebosContext) error {
+	if s.Partition == "" {
+		return errors.New("No partition to sign")
+	}
+
+	if context.imagePartitions == nil {
+		return errors.New("No image to sign, missing image-partition action?")
+	}
+	if _, ok := context.imagePartitions[s.Partition]; !ok {
+		return fmt.Errorf("Unknown partition %s", s.Partition)
+	}
+	if s.SignaturePartition != "" {
+		if _, ok := context.imagePartitions[s.SignaturePartition]; !ok {
+			return fmt.Errorf("Unknown signature partition %s", s.SignaturePartition)
+		}
+	}
+
+	switch {
+	case s.Key != "" && s.KeySecret != "":
+		return errors.New("Only one of key and keysecret can be used")
+	case s.KeySecret != "":
+		key, err := context.secret(s.KeySecret)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(key, "PRIVATE KEY") {
+			return fmt.Errorf("Secret %s isn't a PEM private key", s.KeySecret)
+		}
+	case s.Key != "":
+		s.Key = CleanPathAt(s.Key, context.recipeDir)
+		f, err := os.Open(s.Key)
+		if err != nil {
+			return fmt.Errorf("Couldn't open signing key: %v", err)
+		}
+		defer f.Close()
+		header := make([]byte, 64)
+		n, _ := f.Read(header)
+		if !strings.Contains(string(header[:n]), "PRIVATE KEY") {
+			return fmt.Errorf("%s isn't a PEM private key", s.Key)
+		}
+	default:
+		return errors.New("No signing key given")
+	}
+
+	if s.RootHashFile == "" {
+		s.RootHashFile, _ = context.StringValue(fmt.Sprintf("verity.%s.roothash-file", s.Partition))
+	}
+
+	if s.Output == "" && s.SignaturePartition == "" {
+		s.Output = fmt.Sprintf("%s.%s.sig", path.Base(context.imageFile), s.Partition)
+	}
+
+	return nil
+}
+
+func (s *SignAction) digest(context DebosContext) ([]byte, error) {
+	h := sha256.New()
+
+	if s.RootHashFile != "" {
+		roothash, err := ioutil.ReadFile(path.Join(context.artifactdir, s.RootHashFile))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read root hash: %v", err)
+		}
+		h.Write([]byte(strings.TrimSpace(string(roothash))))
+		return h.Sum(nil), nil
+	}
+
+	offset, size, err := imagePartitionRange(context.imageFile,
+		context.imagePartitions[s.Partition])
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := os.Open(context.imageFile)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	_, err = io.Copy(h, io.NewSectionReader(img, offset, size))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't hash partition %s: %v", s.Partition, err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+func (s *SignAction) PostMachine(context DebosContext) error {
+	s.LogStart()
+	digest, err := s.digest(context)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "debos-sign-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	digestFile := path.Join(tmp, "digest")
+	sigFile := path.Join(tmp, "signature")
+	err = ioutil.WriteFile(digestFile, digest, 0600)
+	if err != nil {
+		return err
+	}
+
+	key := s.Key
+	if s.KeySecret != "" {
+		secret, _ := context.secret(s.KeySecret)
+		key = path.Join(tmp, "key.pem")
+		err = ioutil.WriteFile(key, []byte(secret+"\n"), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := exec.Command("openssl", "pkeyutl", "-sign", "-inkey", key,
+		"-pkeyopt", "digest:sha256", "-in", digestFile, "-out", sigFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Signing failed: %v: %s", err, out)
+	}
+
+	signature, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		return err
+	}
+
+	if s.SignaturePartition == "" {
+		output := path.Join(context.artifactdir, s.Output)
+		log.Printf("Writing signature of %s to %s\n", s.Partition, output)
+		return ioutil.WriteFile(output, signature, 0644)
+	}
+
+	offset, size, err := imagePartitionRange(context.imageFile,
+		context.imagePartitions[s.SignaturePartition])
+	if err != nil {
+		return err
+	}
+	if int64(len(signature)) > size {
+		return fmt.Errorf("Signature doesn't fit in partition %s", s.SignaturePartition)
+	}
+
+	img, err := os.OpenFile(context.imageFile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	log.Printf("Writing signature of %s to partition %s\n", s.Partition, s.SignaturePartition)
+	_, err = img.WriteAt(signature, offset)
+	return err
+}
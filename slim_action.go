@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+/* Shrinks the rootfs by dropping documentation, unwanted locales and
+ * packages. Copyright files are kept */
+type SlimAction struct {
+	BaseAction  `yaml:",inline"`
+	RemoveDocs  bool
+	RemoveMan   bool
+	KeepLocales []string // Locales to keep in /usr/share/locale, all others are removed
+	Purge       []string
+}
+
+/* Disk usage of a tree, not following symlinks */
+func treeSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func removeDocs(rootdir string) error {
+	docdir := path.Join(rootdir, "usr/share/doc")
+	return filepath.Walk(docdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || path.Base(p) == "copyright" {
+			return nil
+		}
+		return os.Remove(p)
+	})
+}
+
+func removeLocales(rootdir string, keep []string) error {
+	localedir := path.Join(rootdir, "usr/share/locale")
+	entries, err := ioutil.ReadDir(localedir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	kept := map[string]bool{"locale.alias": true}
+	for _, k := range keep {
+		kept[k] = true
+	}
+
+	for _, e := range entries {
+		/* Keeping "de" implies keeping "de_DE" and friends */
+		name := e.Name()
+		if kept[name] || kept[strings.SplitN(name, "_", 2)[0]] {
+			continue
+		}
+		err = os.RemoveAll(path.Join(localedir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SlimAction) Run(context *DebosContext) error {
+	s.LogStart()
+	before := treeSize(context.rootdir)
+
+	if len(s.Purge) > 0 {
+		c := NewChrootCommand(context.rootdir, context.Architecture)
+		c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+
+		cmdline := []string{"apt-get", "-y", "purge"}
+		cmdline = append(cmdline, s.Purge...)
+		err := c.Run("slim", cmdline...)
+		if err != nil {
+			return err
+		}
+		err = c.Run("slim", "apt-get", "-y", "autoremove", "--purge")
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.RemoveDocs {
+		err := removeDocs(context.rootdir)
+		if err != nil {
+			return fmt.Errorf("Couldn't remove documentation: %v", err)
+		}
+	}
+
+	if s.RemoveMan {
+		err := os.RemoveAll(path.Join(context.rootdir, "usr/share/man"))
+		if err != nil {
+			return fmt.Errorf("Couldn't remove manpages: %v", err)
+		}
+	}
+
+	if s.KeepLocales != nil {
+		err := removeLocales(context.rootdir, s.KeepLocales)
+		if err != nil {
+			return fmt.Errorf("Couldn't remove locales: %v", err)
+		}
+	}
+
+	after := treeSize(context.rootdir)
+	log.Printf("rootfs size %s -> %s\n", units.BytesSize(float64(before)),
+		units.BytesSize(float64(after)))
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/* Boots the finished image under QEMU and fails unless the marker shows up
+ * on the serial console in time. Runs after the build like signing does, on
+ * a snapshot so the image itself is left untouched */
+type SmokeTestAction struct {
+	BaseAction `yaml:",inline"`
+	Image      string // Defaults to the image of the image-partition action
+	Marker     string
+	Timeout    string
+	Machine    string
+	Memory     string
+	Firmware   string // e.g. an OVMF image for EFI boot
+	Qemu       string
+	timeout    time.Duration
+}
+
+func newSmokeTestAction() *SmokeTestAction {
+	return &SmokeTestAction{Marker: "login:", Timeout: "5m", Memory: "1024"}
+}
+
+/* System emulator and default machine type per debian architecture */
+var smokeTestQemu = map[string][2]string{
+	"amd64": {"qemu-system-x86_64", "q35"},
+	"i386":  {"qemu-system-i386", "q35"},
+	"arm64": {"qemu-system-aarch64", "virt"},
+	"armhf": {"qemu-system-arm", "virt"},
+	"armel": {"qemu-system-arm", "virt"},
+}
+
+func (st *SmokeTestAction) Verify(context *DebosContext) error {
+	if st.Image == "" {
+		st.Image = context.imageFile
+	}
+	if st.Image == "" {
+		return errors.New("No image to boot, missing image-partition action?")
+	}
+
+	if st.Marker == "" {
+		return errors.New("No marker to wait for")
+	}
+
+	timeout, err := time.ParseDuration(st.Timeout)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse timeout %s: %v", st.Timeout, err)
+	}
+	st.timeout = timeout
+
+	defaults, ok := smokeTestQemu[context.Architecture]
+	if st.Qemu == "" {
+		if !ok {
+			return fmt.Errorf("Don't know qemu for architecture %s", context.Architecture)
+		}
+		st.Qemu = defaults[0]
+	}
+	if st.Machine == "" {
+		st.Machine = defaults[1]
+	}
+
+	return nil
+}
+
+func (st *SmokeTestAction) PostMachine(context DebosContext) error {
+	st.LogStart()
+
+	args := []string{"-machine", st.Machine, "-m", st.Memory,
+		"-display", "none", "-serial", "stdio", "-monitor", "none", "-snapshot",
+		"-drive", fmt.Sprintf("file=%s,format=raw,if=virtio", st.Image)}
+	if strings.HasSuffix(st.Machine, "virt") {
+		args = append(args, "-cpu", "max")
+	}
+	if st.Firmware != "" {
+		args = append(args, "-bios", CleanPathAt(st.Firmware, context.recipeDir))
+	}
+
+	cmd := exec.Command(st.Qemu, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Couldn't start %s: %v", st.Qemu, err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	found := make(chan bool, 1)
+	go func() {
+		/* Split on the marker rather than lines, a login prompt doesn't end
+		 * with a newline */
+		r := bufio.NewReader(out)
+		var seen string
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				found <- false
+				return
+			}
+			if b == '\n' {
+				log.Printf("smoke-test | %s\n", strings.TrimRight(seen, "\r"))
+				seen = ""
+				continue
+			}
+			seen += string(b)
+			if strings.HasSuffix(seen, st.Marker) {
+				found <- true
+				return
+			}
+		}
+	}()
+
+	select {
+	case ok := <-found:
+		if !ok {
+			return fmt.Errorf("%s exited before %q was seen", st.Qemu, st.Marker)
+		}
+		log.Printf("Image booted, found %q\n", st.Marker)
+		return nil
+	case <-time.After(st.timeout):
+		return fmt.Errorf("Image didn't boot: %q not seen within %v", st.Marker, st.timeout)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"syscall"
+)
+
+/* Turns the rootfs as populated so far into the lower layer of an overlayfs,
+ * with all later actions writing to the upper layer. A later stage-overlay
+ * action with discard set throws away the upper layer again, so e.g. several
+ * variants can be built on top of one bootstrapped base. One with remove set
+ * takes the overlay down, throwing away the upper layer and making the lower
+ * one the rootfs again, e.g. to keep build-only tools out of the image.
+ * Actions reading the rootdir (pack, filesystem-deploy) see the flattened,
+ * merged tree. */
+type StageOverlayAction struct {
+	BaseAction `yaml:",inline"`
+	Discard    bool
+	Remove     bool
+	mountpoint string
+}
+
+func (so *StageOverlayAction) Verify(context *DebosContext) error {
+	if so.Discard && so.Remove {
+		return fmt.Errorf("Only one of discard and remove can be used")
+	}
+	return nil
+}
+
+func overlayDirs(context *DebosContext) (lower, upper, work string) {
+	lower = path.Join(context.scratchdir, "overlay", "lower")
+	upper = path.Join(context.scratchdir, "overlay", "upper")
+	work = path.Join(context.scratchdir, "overlay", "work")
+	return
+}
+
+func mountRootOverlay(context *DebosContext, mountpoint string) error {
+	lower, upper, work := overlayDirs(context)
+
+	for _, d := range []string{upper, work, mountpoint} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	err := syscall.Mount("overlay", mountpoint, "overlay", 0, options)
+	if err != nil {
+		return fmt.Errorf("Overlay mount failed: %v", err)
+	}
+	context.rootOverlay = mountpoint
+
+	return nil
+}
+
+func (so *StageOverlayAction) Run(context *DebosContext) error {
+	so.LogStart()
+	lower, upper, work := overlayDirs(context)
+
+	if so.Remove {
+		if context.rootOverlay == "" {
+			return fmt.Errorf("No staging overlay to remove")
+		}
+
+		err := unmount(context.rootOverlay, context.killBusy)
+		if err != nil {
+			return fmt.Errorf("Couldn't unmount staging overlay: %v", err)
+		}
+		context.rootOverlay = ""
+
+		os.RemoveAll(upper)
+		os.RemoveAll(work)
+
+		err = os.Remove(context.rootdir)
+		if err == nil {
+			err = os.Rename(lower, context.rootdir)
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't move the lower layer back to the rootfs: %v", err)
+		}
+
+		return nil
+	}
+
+	if so.Discard {
+		mountpoint := context.rootOverlay
+		if mountpoint == "" {
+			return fmt.Errorf("No staging overlay to discard")
+		}
+
+		err := unmount(mountpoint, context.killBusy)
+		if err != nil {
+			return err
+		}
+		context.rootOverlay = ""
+
+		os.RemoveAll(upper)
+		os.RemoveAll(work)
+
+		return mountRootOverlay(context, mountpoint)
+	}
+
+	if context.rootOverlay != "" {
+		return fmt.Errorf("Staging overlay already set up")
+	}
+
+	err := os.MkdirAll(path.Dir(lower), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(context.rootdir, lower)
+	if err != nil {
+		return fmt.Errorf("Couldn't move rootfs to the lower layer: %v", err)
+	}
+
+	err = mountRootOverlay(context, context.rootdir)
+	if err != nil {
+		return err
+	}
+	so.mountpoint = context.rootdir
+
+	return nil
+}
+
+func (so *StageOverlayAction) Cleanup(context DebosContext) error {
+	/* Only the action which set up the overlay tears it down */
+	if so.mountpoint == "" || context.rootOverlay == "" {
+		return nil
+	}
+
+	err := unmount(so.mountpoint, context.killBusy)
+	if err != nil {
+		log.Printf("Failed to unmount staging overlay: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/go-units"
+)
+
+/* Strips ELF executables and libraries in the rootfs. With a debugarchive
+ * set, the debug information is split off first and collected in a tarball
+ * in the artifact directory, using the same paths as in the rootfs plus a
+ * .debug suffix */
+type StripAction struct {
+	BaseAction   `yaml:",inline"`
+	Keep         []string // Globs (relative to the rootfs) of files and directories left alone
+	DebugArchive string
+	Prefix       string // Cross binutils prefix, e.g. aarch64-linux-gnu-
+}
+
+/* Whether a file is an unstripped ELF executable or shared library */
+func needsStrip(p string) bool {
+	f, err := elf.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return false
+	}
+
+	return f.Section(".symtab") != nil || f.Section(".debug_info") != nil
+}
+
+func (s *StripAction) Verify(context *DebosContext) error {
+	return checkKeepPatterns(s.Keep)
+}
+
+func (s *StripAction) Run(context *DebosContext) error {
+	s.LogStart()
+
+	var debugdir string
+	if s.DebugArchive != "" {
+		var err error
+		debugdir, err = ioutil.TempDir(context.scratchdir, "debug-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(debugdir)
+	}
+
+	var reclaimed int64
+	seen := make(map[dedupInode]bool)
+
+	err := filepath.Walk(context.rootdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(context.rootdir, p)
+		if rel != "." && keepPath(s.Keep, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		/* Only handle each hardlinked file once */
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			inode := dedupInode{uint64(st.Dev), st.Ino}
+			if seen[inode] {
+				return nil
+			}
+			seen[inode] = true
+		}
+
+		if !needsStrip(p) {
+			return nil
+		}
+
+		if debugdir != "" {
+			debug := path.Join(debugdir, rel+".debug")
+			os.MkdirAll(path.Dir(debug), 0755)
+			err = Command{}.Run("strip", s.Prefix+"objcopy", "--only-keep-debug", p, debug)
+			if err != nil {
+				return fmt.Errorf("Couldn't split debug info of %s: %v", rel, err)
+			}
+		}
+
+		err = Command{}.Run("strip", s.Prefix+"strip", "--strip-unneeded", p)
+		if err != nil {
+			return fmt.Errorf("Couldn't strip %s: %v", rel, err)
+		}
+
+		stripped, err := os.Stat(p)
+		if err == nil {
+			reclaimed += info.Size() - stripped.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Stripping reclaimed %s\n", units.BytesSize(float64(reclaimed)))
+
+	if debugdir != "" {
+		archive := path.Join(context.artifactdir, s.DebugArchive)
+		return Command{}.Run("strip", "tar", "czf", archive, "-C", debugdir, ".")
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/* Manipulates units with systemctl --root so no running systemd (or dbus) is
+ * needed inside the target */
+type SystemdAction struct {
+	BaseAction `yaml:",inline"`
+	PresetAll  bool
+	Preset     []string
+	Enable     []string
+	Disable    []string
+	Mask       []string
+	Unmask     []string
+}
+
+func (sd *SystemdAction) Verify(context *DebosContext) error {
+	if !sd.PresetAll && len(sd.Preset) == 0 && len(sd.Enable) == 0 &&
+		len(sd.Disable) == 0 && len(sd.Mask) == 0 && len(sd.Unmask) == 0 {
+		return errors.New("No units to configure")
+	}
+
+	return nil
+}
+
+func (sd *SystemdAction) systemctl(context *DebosContext, verb string, units ...string) error {
+	cmdline := []string{"systemctl", fmt.Sprintf("--root=%s", context.rootdir), verb}
+	cmdline = append(cmdline, units...)
+
+	return Command{}.Run("systemctl", cmdline...)
+}
+
+func (sd *SystemdAction) Run(context *DebosContext) error {
+	sd.LogStart()
+
+	if sd.PresetAll {
+		err := sd.systemctl(context, "preset-all")
+		if err != nil {
+			return err
+		}
+	}
+
+	steps := []struct {
+		verb  string
+		units []string
+	}{
+		{"preset", sd.Preset},
+		{"unmask", sd.Unmask},
+		{"enable", sd.Enable},
+		{"disable", sd.Disable},
+		{"mask", sd.Mask},
+	}
+
+	for _, s := range steps {
+		if len(s.units) == 0 {
+			continue
+		}
+		err := sd.systemctl(context, s.verb, s.units...)
+		if err != nil {
+			return fmt.Errorf("systemctl %s failed: %v", s.verb, err)
+		}
+	}
+
+	return nil
+}
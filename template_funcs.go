@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+/* Functions available to recipe templates:
+ *
+ *  sector N [SIZE]       N sectors of 512 or SIZE bytes, in bytes
+ *  env "VAR"             value of VAR in the environment debos was started in
+ *  arch_map ARCH "kind"  Debian architecture translated to the "kernel" or
+ *                        "qemu" naming
+ *  file "path"           contents of a file relative to the recipe directory;
+ *                        files outside of it can't be read
+ *  add, sub, mul, div    integer arithmetic, e.g. {{ mul 4 1024 }}
+ *  exec "cmd" args...    output of a host command, only available when debos
+ *                        is started with --template-exec
+ *  value "key"           value set by an earlier action, see context_values.go
+ */
+
+var archMap = map[string]map[string]string{
+	"kernel": {
+		"amd64": "x86",
+		"i386":  "x86",
+		"arm64": "arm64",
+		"armhf": "arm",
+		"armel": "arm",
+	},
+	"qemu": {
+		"amd64": "x86_64",
+		"i386":  "i386",
+		"arm64": "aarch64",
+		"armhf": "arm",
+		"armel": "arm",
+	},
+}
+
+func templateArchMap(arch, kind string) (string, error) {
+	m, ok := archMap[kind]
+	if !ok {
+		return "", fmt.Errorf("Unknown architecture naming %s", kind)
+	}
+
+	a, ok := m[arch]
+	if !ok {
+		return "", fmt.Errorf("No %s name for architecture %s", kind, arch)
+	}
+
+	return a, nil
+}
+
+func templateDiv(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("Division by zero")
+	}
+	return a / b, nil
+}
+
+func templateFile(recipeDir string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		/* Symlinks can't lead out of the recipe directory either */
+		p, err := filepath.EvalSymlinks(CleanPathAt(name, recipeDir))
+		if err != nil {
+			return "", err
+		}
+		dir, err := filepath.EvalSymlinks(recipeDir)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("%s is outside of the recipe directory", name)
+		}
+
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	}
+}
+
+func templateExec(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func templateFuncs(context *DebosContext, allowExec bool) template.FuncMap {
+	funcs := template.FuncMap{
+		"sector":   sector,
+		"env":      os.Getenv,
+		"arch_map": templateArchMap,
+		"file":     templateFile(context.recipeDir),
+		"add":      func(a, b int) int { return a + b },
+		"sub":      func(a, b int) int { return a - b },
+		"mul":      func(a, b int) int { return a * b },
+		"div":      templateDiv,
+		"value":    templateDeferredValue,
+	}
+
+	if allowExec {
+		funcs["exec"] = templateExec
+	} else {
+		funcs["exec"] = func(string, ...string) (string, error) {
+			return "", errors.New("exec not enabled, use --template-exec")
+		}
+	}
+
+	return funcs
+}
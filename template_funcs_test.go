@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTemplateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recipeDir := path.Join(dir, "recipe")
+	os.Mkdir(recipeDir, 0755)
+	ioutil.WriteFile(path.Join(recipeDir, "..foo"), []byte("inside"), 0644)
+	ioutil.WriteFile(path.Join(dir, "secret"), []byte("outside"), 0644)
+	os.Symlink("../secret", path.Join(recipeDir, "link"))
+
+	file := templateFile(recipeDir)
+	if content, err := file("..foo"); err != nil || content != "inside" {
+		t.Errorf("Couldn't read ..foo: %v", err)
+	}
+	for _, name := range []string{"../secret", "link"} {
+		if _, err := file(name); err == nil {
+			t.Errorf("%s outside of the recipe directory was read", name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+type TimezoneAction struct {
+	BaseAction `yaml:",inline"`
+	Timezone   string
+}
+
+func (tz *TimezoneAction) Verify(context *DebosContext) error {
+	if tz.Timezone == "" {
+		return errors.New("No timezone given")
+	}
+
+	if strings.HasPrefix(tz.Timezone, "/") || strings.Contains(tz.Timezone, "..") {
+		return fmt.Errorf("Invalid timezone %s", tz.Timezone)
+	}
+
+	return nil
+}
+
+func (tz *TimezoneAction) Run(context *DebosContext) error {
+	tz.LogStart()
+	zoneinfo := path.Join("/usr/share/zoneinfo", tz.Timezone)
+
+	_, err := os.Stat(path.Join(context.rootdir, zoneinfo))
+	if err != nil {
+		return fmt.Errorf("Unknown timezone %s, tzdata not installed?", tz.Timezone)
+	}
+
+	localtime := path.Join(context.rootdir, "etc/localtime")
+	os.Remove(localtime)
+	err = os.Symlink(zoneinfo, localtime)
+	if err != nil {
+		return fmt.Errorf("Couldn't link localtime: %v", err)
+	}
+
+	return ioutil.WriteFile(path.Join(context.rootdir, "etc/timezone"),
+		[]byte(tz.Timezone+"\n"), 0644)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Builds a Unified Kernel Image out of the kernel, initrd, commandline and
+ * os-release of the rootfs with ukify, and puts it on the ESP where
+ * systemd-boot picks it up. The commandline is expanded at run time, so
+ * values of earlier actions can go in, e.g. a verity root hash. Signing
+ * for Secure Boot is done with sbsign on the host */
+type UkiAction struct {
+	BaseAction `yaml:",inline"`
+	Kernel     string // Kernel version, defaults to the newest installed
+	Linux      string // Kernel image in the rootfs, /boot/vmlinuz-VERSION by default
+	Initrd     string // In the rootfs, the initramfs action's or /boot/initrd.img-VERSION
+	Cmdline    string // Defaults to /etc/kernel/cmdline or the image root
+	Output     string // In the rootfs, defaults to /boot/efi/EFI/Linux/VERSION.efi
+	Key        string // Secure Boot signing key and certificate, relative to the recipe
+	Cert       string
+}
+
+func (uki *UkiAction) Verify(context *DebosContext) error {
+	if (uki.Key == "") != (uki.Cert == "") {
+		return errors.New("Signing needs both a key and a certificate")
+	}
+
+	for _, f := range []*string{&uki.Key, &uki.Cert} {
+		if *f == "" {
+			continue
+		}
+		*f = CleanPathAt(*f, context.recipeDir)
+		if _, err := os.Stat(*f); err != nil {
+			return fmt.Errorf("Couldn't find signing file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (uki *UkiAction) cmdline(context *DebosContext) (string, error) {
+	if uki.Cmdline != "" {
+		return context.expandTemplate("cmdline", uki.Cmdline)
+	}
+
+	current, err := ioutil.ReadFile(path.Join(context.rootdir, "etc/kernel/cmdline"))
+	if err == nil {
+		return strings.TrimSpace(string(current)), nil
+	}
+
+	if context.imageKernelRoot == "" {
+		return "", errors.New("No kernel commandline, nor an image root")
+	}
+	return context.imageKernelRoot, nil
+}
+
+func (uki *UkiAction) valueFields() []string {
+	return []string{uki.Cmdline}
+}
+
+func (uki *UkiAction) Run(context *DebosContext) error {
+	uki.LogStart()
+
+	version := uki.Kernel
+	if version == "" {
+		var err error
+		version, err = newestKernelVersion(context.rootdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	linux := uki.Linux
+	if linux == "" {
+		linux = fmt.Sprintf("/boot/vmlinuz-%s", version)
+	}
+	initrd := uki.Initrd
+	if initrd == "" {
+		initrd = fmt.Sprintf("/boot/initrd.img-%s", version)
+		/* The initramfs action's may be for another kernel than the one
+		 * asked for */
+		if generated, err := context.StringValue("initrd"); err == nil && uki.Kernel == "" {
+			initrd = generated
+		}
+	}
+	output := uki.Output
+	if output == "" {
+		output = fmt.Sprintf("/boot/efi/EFI/Linux/%s.efi", version)
+	}
+
+	for _, f := range []string{linux, initrd} {
+		if _, err := os.Stat(path.Join(context.rootdir, f)); err != nil {
+			return fmt.Errorf("Couldn't find %s: %v", f, err)
+		}
+	}
+
+	cmdline, err := uki.cmdline(context)
+	if err != nil {
+		return err
+	}
+	log.Printf("Building UKI for %s with commandline %s\n", version, cmdline)
+
+	err = os.MkdirAll(path.Join(context.rootdir, path.Dir(output)), 0755)
+	if err != nil {
+		return err
+	}
+
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	err = c.Run("uki", "ukify", "build", "--linux", linux, "--initrd", initrd,
+		"--cmdline", cmdline, "--os-release", "@/etc/os-release", "--uname", version,
+		"--output", output)
+	if err != nil {
+		return err
+	}
+
+	if uki.Key != "" {
+		file := path.Join(context.rootdir, output)
+		err = Command{}.Run("uki", "sbsign", "--key", uki.Key, "--cert", uki.Cert,
+			"--output", file, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	context.SetValue("uki", output)
+
+	return nil
+}
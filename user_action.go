@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type UserAction struct {
+	BaseAction       `yaml:",inline"`
+	Username         string
+	Uid              int
+	Home             string
+	Shell            string
+	System           bool
+	Groups           []string
+	Password         string // Pre-hashed password as found in /etc/shadow
+	PasswordSecret   string // Secret holding the password, plain or hashed
+	GeneratePassword bool
+	AuthorizedKeys   []string
+}
+
+/* What useradd and groupadd accept by default, which also keeps names safe
+ * to use in shell commands */
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+func (u *UserAction) Verify(context *DebosContext) error {
+	if u.Username == "" {
+		return errors.New("User without a username")
+	}
+	if !userNameRegexp.MatchString(u.Username) {
+		return fmt.Errorf("Invalid username %s", u.Username)
+	}
+	for _, g := range u.Groups {
+		if !userNameRegexp.MatchString(g) {
+			return fmt.Errorf("User %s: invalid group name %s", u.Username, g)
+		}
+	}
+
+	set := 0
+	for _, p := range []bool{u.Password != "", u.PasswordSecret != "", u.GeneratePassword} {
+		if p {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("User %s has more than one of password, passwordsecret and generatepassword set",
+			u.Username)
+	}
+
+	if u.PasswordSecret != "" {
+		if _, err := context.secret(u.PasswordSecret); err != nil {
+			return fmt.Errorf("User %s: %v", u.Username, err)
+		}
+	}
+
+	/* Refuse anything that looks like a plaintext password, chpasswd -e
+	 * would happily store it as an invalid hash */
+	if u.Password != "" && !strings.HasPrefix(u.Password, "$") &&
+		u.Password != "*" && u.Password != "!" {
+		return fmt.Errorf("Password for user %s isn't hashed", u.Username)
+	}
+
+	return nil
+}
+
+func (u *UserAction) generatePassword(context *DebosContext) (string, error) {
+	b := make([]byte, 18)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+
+	/* Only the artifact keeps the plaintext, the image gets it hashed by
+	 * chpasswd */
+	file := path.Join(context.artifactdir, fmt.Sprintf("%s.password", u.Username))
+	err = ioutil.WriteFile(file, []byte(password+"\n"), 0600)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't store generated password: %v", err)
+	}
+	log.Printf("Generated password for %s stored in %s\n", u.Username, file)
+
+	return password, nil
+}
+
+func (u *UserAction) Run(context *DebosContext) error {
+	u.LogStart()
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+
+	for _, g := range u.Groups {
+		/* -f succeeds for groups which exist already */
+		err := c.Run("user", "groupadd", "-f", g)
+		if err != nil {
+			return fmt.Errorf("Couldn't create group %s: %v", g, err)
+		}
+	}
+
+	cmdline := []string{"useradd", "-m"}
+	if u.System {
+		cmdline = append(cmdline, "--system")
+	}
+	if u.Uid != 0 {
+		cmdline = append(cmdline, "-u", fmt.Sprintf("%d", u.Uid))
+	}
+	if u.Home != "" {
+		cmdline = append(cmdline, "-d", u.Home)
+	}
+	if u.Shell != "" {
+		cmdline = append(cmdline, "-s", u.Shell)
+	}
+	if len(u.Groups) > 0 {
+		cmdline = append(cmdline, "-G", strings.Join(u.Groups, ","))
+	}
+	cmdline = append(cmdline, u.Username)
+
+	err := c.Run("useradd", cmdline...)
+	if err != nil {
+		return err
+	}
+
+	if u.Password != "" || u.PasswordSecret != "" || u.GeneratePassword {
+		/* Pass the password on stdin so it never shows up on a command
+		 * line or in the environment of nspawn */
+		pc := NewChrootCommand(context.rootdir, context.Architecture)
+		var password string
+		chpasswd := []string{"chpasswd"}
+		switch {
+		case u.GeneratePassword:
+			password, err = u.generatePassword(context)
+			if err != nil {
+				return err
+			}
+			pc.AddSensitive(password)
+		case u.PasswordSecret != "":
+			password, _ = context.secret(u.PasswordSecret)
+			pc.AddSensitive(password)
+			if strings.HasPrefix(password, "$") {
+				chpasswd = append(chpasswd, "-e")
+			}
+		default:
+			password = u.Password
+			pc.AddSensitive(password)
+			chpasswd = append(chpasswd, "-e")
+		}
+
+		pc.SetStdin(fmt.Sprintf("%s:%s\n", u.Username, password))
+		err = pc.Run("chpasswd", chpasswd...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(u.AuthorizedKeys) > 0 {
+		c.AddEnvKey("DEBOS_KEYS", strings.Join(u.AuthorizedKeys, "\n"))
+		script := fmt.Sprintf(`set -e
+home=$(getent passwd %[1]s | cut -d: -f6)
+install -d -m 700 -o %[1]s -g $(id -g %[1]s) "$home/.ssh"
+printf '%%s\n' "$DEBOS_KEYS" > "$home/.ssh/authorized_keys"
+chown %[1]s:$(id -g %[1]s) "$home/.ssh/authorized_keys"
+chmod 600 "$home/.ssh/authorized_keys"`, u.Username)
+
+		err = c.Run("authorized_keys", "sh", "-c", script)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
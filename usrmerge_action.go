@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+)
+
+/* Converts an already bootstrapped split-/usr rootfs to the merged-/usr
+ * layout, where /bin, /sbin and /lib are symlinks into /usr. Overlays should
+ * match the layout of the rootfs, e.g. ship files in /usr/bin rather than /bin
+ * for merged-/usr */
+type UsrMergeAction struct {
+	BaseAction `yaml:",inline"`
+}
+
+var usrMergedDirs = []string{"bin", "sbin", "lib"}
+
+/* Whether the rootfs uses the merged-/usr layout */
+func isMergedUsr(rootdir string) bool {
+	fi, err := os.Lstat(path.Join(rootdir, "bin"))
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+/* Warn about overlay trees which don't match the /usr layout of the rootfs */
+func checkUsrLayout(source, rootdir string) {
+	merged := isMergedUsr(rootdir)
+	for _, d := range usrMergedDirs {
+		fi, err := os.Lstat(path.Join(source, d))
+		if err != nil {
+			continue
+		}
+		if merged && fi.IsDir() {
+			log.Printf("Warning: %s has a /%s directory but the rootfs is merged-/usr\n", source, d)
+		} else if !merged && fi.Mode()&os.ModeSymlink != 0 {
+			log.Printf("Warning: %s has a /%s symlink but the rootfs is split-/usr\n", source, d)
+		}
+	}
+}
+
+func (u *UsrMergeAction) Run(context *DebosContext) error {
+	u.LogStart()
+	if isMergedUsr(context.rootdir) {
+		log.Printf("rootfs is already merged-/usr\n")
+		return nil
+	}
+
+	/* Installing usrmerge converts the system as part of its postinst */
+	c := NewChrootCommand(context.rootdir, context.Architecture)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+
+	err := withAptProxy(context, func() error {
+		return c.Run("usrmerge", "apt-get", "-y", "--no-install-recommends",
+			"install", "usrmerge")
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Run("usrmerge", "apt-get", "clean")
+}
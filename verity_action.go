@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+/* Protects the /usr partition of the image with dm-verity the way systemd
+ * sets it up: the partition is remounted read-only as it is final from here
+ * on, its hash tree written to the hash partition and both partitions get the
+ * partition uuids systemd derives from the root hash, which is passed as
+ * usrhash= on the kernel commandline. /usr is mounted from /dev/mapper/usr
+ * then. So this has to come after filesystem-deploy and anything else
+ * changing /usr, which fails from here on, and before uki, which picks up the
+ * commandline and still can run tools from /usr. The root hash is set as the
+ * verity.NAME.roothash value as well, and written to IMAGE.NAME.roothash in
+ * the artifact directory, which the sign action signs for the partition */
+type VerityAction struct {
+	BaseAction    `yaml:",inline"`
+	Partition     string
+	HashPartition string
+}
+
+var verityRootHashRegexp = regexp.MustCompile(`Root hash:\s+([0-9a-f]{64})`)
+
+func (va *VerityAction) Verify(context *DebosContext) error {
+	if va.Partition == "" || va.HashPartition == "" {
+		return errors.New("Verity needs a partition and a hash partition")
+	}
+
+	if context.imagePartitions == nil {
+		return errors.New("No image to protect, missing image-partition action?")
+	}
+	for _, p := range []string{va.Partition, va.HashPartition} {
+		if _, ok := context.imagePartitions[p]; !ok {
+			return fmt.Errorf("Unknown partition %s", p)
+		}
+	}
+
+	/* squashfs and erofs only get built once the image is unmounted, after
+	 * the hash tree would have been made */
+	for _, p := range context.imageLayout.Partitions {
+		if p.Name == va.Partition && isReadOnlyFS(p.FS) {
+			return fmt.Errorf("Partition %s: verity can't protect a %s partition, it's built too late",
+				p.Name, p.FS)
+		}
+	}
+
+	/* Set here already, for the sign action running after the machine */
+	context.SetValue(fmt.Sprintf("verity.%s.roothash-file", va.Partition), va.rootHashFile(context))
+
+	return nil
+}
+
+/* systemd looks for the data partition by the first and the hash partition
+ * by the last 128 bits of the root hash */
+func verityPartitionUUIDs(roothash string) (string, string) {
+	uuid := func(h string) string {
+		return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+	}
+	return uuid(roothash[:32]), uuid(roothash[32:])
+}
+
+func appendKernelCmdline(rootdir, option string) error {
+	f, err := os.OpenFile(path.Join(rootdir, "etc/kernel/cmdline"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't open kernel cmdline: %v", err)
+	}
+	defer f.Close()
+
+	current, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strings.TrimSpace(string(current))+" "+option+"\n"), 0)
+	}
+	return err
+}
+
+func (va *VerityAction) rootHashFile(context *DebosContext) string {
+	return fmt.Sprintf("%s.%s.roothash", path.Base(context.imageFile), va.Partition)
+}
+
+func (va *VerityAction) Run(context *DebosContext) error {
+	va.LogStart()
+
+	mountpoint, err := context.StringValue(fmt.Sprintf("partition.%s.mountpoint", va.Partition))
+	if err != nil || mountpoint != "/usr" {
+		return fmt.Errorf("Partition %s isn't mounted as /usr", va.Partition)
+	}
+
+	/* Read-only the filesystem doesn't change under the hash tree, yet the
+	 * chroot keeps its /usr; image-partition unmounts it as usual */
+	err = syscall.Mount("", path.Join(context.imageMntDir, mountpoint), "",
+		syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	if err != nil {
+		return fmt.Errorf("Couldn't remount %s read-only: %v", mountpoint, err)
+	}
+
+	image := ImagePartitionAction{}
+	data := image.getPartitionDevice(context.imagePartitions[va.Partition], *context)
+	hash := image.getPartitionDevice(context.imagePartitions[va.HashPartition], *context)
+
+	out, err := exec.Command("veritysetup", "format", data, hash).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("veritysetup failed: %v: %s", err, out)
+	}
+	m := verityRootHashRegexp.FindStringSubmatch(string(out))
+	if m == nil {
+		return errors.New("No root hash in the veritysetup output")
+	}
+	roothash := m[1]
+	log.Printf("Root hash of %s: %s\n", va.Partition, roothash)
+	context.SetValue(fmt.Sprintf("verity.%s.roothash", va.Partition), roothash)
+	err = ioutil.WriteFile(path.Join(context.artifactdir, va.rootHashFile(context)),
+		[]byte(roothash+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write root hash: %v", err)
+	}
+
+	dataUUID, hashUUID := verityPartitionUUIDs(roothash)
+	for p, uuid := range map[string]string{va.Partition: dataUUID, va.HashPartition: hashUUID} {
+		err = Command{}.Run("verity", "sgdisk",
+			fmt.Sprintf("--partition-guid=%d:%s", context.imagePartitions[p], uuid), context.image)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = editFstabEntry(context.rootdir, "/usr", func(fields []string) {
+		fields[0] = "/dev/mapper/usr"
+		if !strings.Contains(","+fields[3]+",", ",ro,") {
+			fields[3] += ",ro"
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return appendKernelCmdline(context.rootdir, "usrhash="+roothash)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/* Content is part of the recipe, so it has already been through the recipe
+ * templating by the time it gets here; with values set it is templated once
+ * more when written, for the values of earlier actions. The path is in the
+ * rootfs, with symlinks followed as they would be inside it */
+type WriteFileAction struct {
+	BaseAction `yaml:",inline"`
+	Path       string
+	Content    string
+	Values     bool // Expand value calls in the content when writing
+	Owner      string
+	Group      string
+	Mode       string
+	Append     bool
+	mode       os.FileMode
+}
+
+func (wf *WriteFileAction) valueFields() []string {
+	if !wf.Values {
+		return nil
+	}
+	return []string{wf.Content}
+}
+
+func (wf *WriteFileAction) Verify(context *DebosContext) error {
+	if wf.Path == "" {
+		return errors.New("No path to write to")
+	}
+	for _, c := range strings.Split(wf.Path, "/") {
+		if c == ".." {
+			return fmt.Errorf("Path %s mustn't contain ..", wf.Path)
+		}
+	}
+
+	wf.mode = 0644
+	if wf.Mode != "" {
+		m, err := strconv.ParseUint(wf.Mode, 8, 32)
+		if err != nil || m > 07777 {
+			return fmt.Errorf("Couldn't parse mode %s", wf.Mode)
+		}
+		/* os.FileMode has its own bits for these */
+		wf.mode = os.FileMode(m & 0777)
+		for bit, mode := range map[uint64]os.FileMode{
+			04000: os.ModeSetuid, 02000: os.ModeSetgid, 01000: os.ModeSticky,
+		} {
+			if m&bit != 0 {
+				wf.mode |= mode
+			}
+		}
+	}
+
+	return nil
+}
+
+func (wf *WriteFileAction) Run(context *DebosContext) error {
+	wf.LogStart()
+	target, err := rootfsPath(context.rootdir, wf.Path)
+	if err != nil {
+		return err
+	}
+
+	content := wf.Content
+	if wf.Values {
+		content, err = context.expandTemplate("content", wf.Content)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(path.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("Couldn't create directory for %s: %v", wf.Path, err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if wf.Append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(target, flags, wf.mode)
+	if err != nil {
+		return fmt.Errorf("Couldn't open %s: %v", wf.Path, err)
+	}
+
+	_, err = f.WriteString(content)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Couldn't write %s: %v", wf.Path, err)
+	}
+	f.Close()
+
+	/* Set explicitly as the file may have existed or been affected by the
+	 * umask */
+	if wf.Mode != "" {
+		err = os.Chmod(target, wf.mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if wf.Owner != "" || wf.Group != "" {
+		/* Resolve names against the targets passwd/group rather than the hosts */
+		owner := wf.Owner
+		if wf.Group != "" {
+			owner = fmt.Sprintf("%s:%s", wf.Owner, wf.Group)
+		}
+		c := NewChrootCommand(context.rootdir, context.Architecture)
+		err = c.Run("write-file", "chown", owner, strings.TrimPrefix(target, context.rootdir))
+		if err != nil {
+			return fmt.Errorf("Couldn't change ownership of %s: %v", wf.Path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/* Sets up compressed swap in RAM with zram-generator, which creates the
+ * zram devices and their swap units at boot from
+ * /etc/systemd/zram-generator.conf, so nothing needs to be enabled besides
+ * writing the config. The generator has to be in the rootfs, or gets
+ * installed with apt when install is set */
+type ZramAction struct {
+	BaseAction `yaml:",inline"`
+	Size       string // zram-size expression, of ram in MiB
+	Algorithm  string
+	Priority   int
+	Devices    int  // Each getting the full size
+	Install    bool // Install systemd-zram-generator first
+}
+
+/* Compressors the kernel zram driver may offer */
+var zramAlgorithms = map[string]bool{
+	"lzo": true, "lzo-rle": true, "lz4": true, "lz4hc": true, "zstd": true,
+	"deflate": true, "842": true,
+}
+
+/* zram-generator evaluates sizes as arithmetic on ram with min and max */
+var zramSizeRegexp = regexp.MustCompile(`^[0-9a-z()+\-*/., ]+$`)
+
+var zramGenerators = []string{
+	"usr/lib/systemd/system-generators/zram-generator",
+	"lib/systemd/system-generators/zram-generator",
+}
+
+func newZramAction() *ZramAction {
+	return &ZramAction{Size: "min(ram / 2, 4096)", Algorithm: "zstd", Priority: 100, Devices: 1}
+}
+
+func (z *ZramAction) Verify(context *DebosContext) error {
+	if !zramAlgorithms[z.Algorithm] {
+		return fmt.Errorf("Unknown zram compression algorithm %s", z.Algorithm)
+	}
+	if !zramSizeRegexp.MatchString(z.Size) {
+		return fmt.Errorf("Invalid zram size %s", z.Size)
+	}
+	if z.Devices < 1 {
+		return errors.New("At least one zram device is needed")
+	}
+	if z.Priority < -1 || z.Priority > 32767 {
+		return fmt.Errorf("Invalid swap priority %d", z.Priority)
+	}
+	return nil
+}
+
+func (z *ZramAction) Run(context *DebosContext) error {
+	z.LogStart()
+
+	if z.Install {
+		c := NewChrootCommand(context.rootdir, context.Architecture)
+		c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+
+		err := withAptProxy(context, func() error {
+			return c.Run("zram", "apt-get", "-y", "--no-install-recommends",
+				"install", "systemd-zram-generator")
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	installed := false
+	for _, g := range zramGenerators {
+		if _, err := os.Stat(path.Join(context.rootdir, g)); err == nil {
+			installed = true
+		}
+	}
+	if !installed {
+		return errors.New("zram-generator isn't installed in the rootfs")
+	}
+
+	var conf strings.Builder
+	for idx := 0; idx < z.Devices; idx++ {
+		if idx > 0 {
+			conf.WriteString("\n")
+		}
+		fmt.Fprintf(&conf, "[zram%d]\nzram-size = %s\ncompression-algorithm = %s\nswap-priority = %d\n",
+			idx, z.Size, z.Algorithm, z.Priority)
+	}
+
+	err := os.MkdirAll(path.Join(context.rootdir, "etc/systemd"), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(context.rootdir, "etc/systemd/zram-generator.conf"),
+		[]byte(conf.String()), 0644)
+}